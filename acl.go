@@ -0,0 +1,238 @@
+package fsutil
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// POSIX ACLs are stored in these extended attributes
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// PAX records used by star and GNU tar for POSIX ACLs
+const (
+	paxACLAccess  = "SCHILY.acl.access"
+	paxACLDefault = "SCHILY.acl.default"
+	paxXattr      = "SCHILY.xattr."
+)
+
+// entry tags of the posix_acl_xattr format
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+
+	aclXattrVersion = 2
+	aclUndefinedID  = 0xffffffff
+)
+
+var aclTags = []struct {
+	tag  uint16
+	name string
+	abbr string
+}{
+	{aclUserObj, "user", "u"},
+	{aclUser, "user", "u"},
+	{aclGroupObj, "group", "g"},
+	{aclGroup, "group", "g"},
+	{aclMask, "mask", "m"},
+	{aclOther, "other", "o"},
+}
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// ACLToText converts the value of a system.posix_acl_access or
+// system.posix_acl_default xattr to the short text form with numeric ids,
+// e.g. "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r--".
+func ACLToText(dt []byte) (string, error) {
+	if len(dt) < 4 || (len(dt)-4)%8 != 0 || binary.LittleEndian.Uint32(dt) != aclXattrVersion {
+		return "", errors.New("invalid acl xattr")
+	}
+	var out []string
+	for b := dt[4:]; len(b) > 0; b = b[8:] {
+		e := aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		}
+		var name string
+		for _, t := range aclTags {
+			if t.tag == e.tag {
+				name = t.name
+			}
+		}
+		if name == "" {
+			return "", errors.Errorf("invalid acl tag %#x", e.tag)
+		}
+		var qualifier string
+		if e.tag == aclUser || e.tag == aclGroup {
+			qualifier = strconv.FormatUint(uint64(e.id), 10)
+		}
+		out = append(out, name+":"+qualifier+":"+aclPerm(e.perm))
+	}
+	return strings.Join(out, ","), nil
+}
+
+// ACLFromText converts the text form of an ACL back to the xattr value.
+// Entries can be separated by commas or newlines. Named users and groups
+// need numeric ids, either as the qualifier or as a fourth field like star
+// writes them.
+func ACLFromText(s string) ([]byte, error) {
+	var entries []aclEntry
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if i := strings.Index(f, "#"); i >= 0 {
+			f = f[:i]
+		}
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.Split(f, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, errors.Errorf("invalid acl entry %q", f)
+		}
+		qualifier := parts[1]
+		if len(parts) == 4 {
+			qualifier = parts[3]
+		}
+		e := aclEntry{id: aclUndefinedID}
+		switch parts[0] {
+		case "user", "u":
+			e.tag = aclUserObj
+			if qualifier != "" {
+				e.tag = aclUser
+			}
+		case "group", "g":
+			e.tag = aclGroupObj
+			if qualifier != "" {
+				e.tag = aclGroup
+			}
+		case "mask", "m":
+			e.tag = aclMask
+		case "other", "o":
+			e.tag = aclOther
+		default:
+			return nil, errors.Errorf("invalid acl entry %q", f)
+		}
+		if e.tag == aclUser || e.tag == aclGroup {
+			id, err := strconv.ParseUint(qualifier, 10, 32)
+			if err != nil {
+				return nil, errors.Errorf("invalid acl entry %q: only numeric ids are supported", f)
+			}
+			e.id = uint32(id)
+		}
+		for _, c := range parts[2] {
+			switch c {
+			case 'r':
+				e.perm |= 4
+			case 'w':
+				e.perm |= 2
+			case 'x':
+				e.perm |= 1
+			case '-':
+			default:
+				return nil, errors.Errorf("invalid acl entry %q", f)
+			}
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+
+	dt := make([]byte, 4+8*len(entries))
+	binary.LittleEndian.PutUint32(dt, aclXattrVersion)
+	for i, e := range entries {
+		b := dt[4+8*i:]
+		binary.LittleEndian.PutUint16(b, e.tag)
+		binary.LittleEndian.PutUint16(b[2:], e.perm)
+		binary.LittleEndian.PutUint32(b[4:], e.id)
+	}
+	return dt, nil
+}
+
+func aclPerm(p uint16) string {
+	b := []byte("---")
+	if p&4 != 0 {
+		b[0] = 'r'
+	}
+	if p&2 != 0 {
+		b[1] = 'w'
+	}
+	if p&1 != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+// xattrsToPAX converts xattrs to the PAX records of a tar header. POSIX
+// ACLs are written as SCHILY.acl records in text form.
+func xattrsToPAX(xattrs map[string][]byte) (map[string]string, error) {
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	records := map[string]string{}
+	for k, v := range xattrs {
+		switch k {
+		case xattrACLAccess, xattrACLDefault:
+			s, err := ACLToText(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to convert %s", k)
+			}
+			if k == xattrACLAccess {
+				records[paxACLAccess] = s
+			} else {
+				records[paxACLDefault] = s
+			}
+		default:
+			records[paxXattr+k] = string(v)
+		}
+	}
+	return records, nil
+}
+
+// XattrsFromPAX returns the xattrs stored in the PAX records of a tar
+// header, including POSIX ACLs stored as SCHILY.acl records.
+func XattrsFromPAX(records map[string]string) (map[string][]byte, error) {
+	var xattrs map[string][]byte
+	for k, v := range records {
+		var key string
+		var value []byte
+		switch {
+		case k == paxACLAccess || k == paxACLDefault:
+			dt, err := ACLFromText(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to convert %s", k)
+			}
+			key, value = xattrACLAccess, dt
+			if k == paxACLDefault {
+				key = xattrACLDefault
+			}
+		case strings.HasPrefix(k, paxXattr):
+			key, value = strings.TrimPrefix(k, paxXattr), []byte(v)
+		default:
+			continue
+		}
+		if xattrs == nil {
+			xattrs = map[string][]byte{}
+		}
+		xattrs[key] = value
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,30 @@
+// +build linux
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/containerd/continuity/sysx"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// removeInheritedACLs removes the ACLs that new files inherit from the
+// default ACL of their parent directory if the stat does not have them
+func removeInheritedACLs(p string, stat *types.Stat, filter *XattrFilter) error {
+	keys := []string{xattrACLAccess}
+	if os.FileMode(stat.Mode).IsDir() {
+		keys = append(keys, xattrACLDefault)
+	}
+	for _, key := range keys {
+		if _, ok := stat.Xattrs[key]; ok || !filter.Match(key) {
+			continue
+		}
+		if err := sysx.LRemovexattr(p, key); err != nil && !errors.Is(err, sysx.ENODATA) && !errors.Is(err, syscall.ENOTSUP) {
+			return errors.Wrapf(err, "failed to remove %s from %s", key, p)
+		}
+	}
+	return nil
+}
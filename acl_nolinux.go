@@ -0,0 +1,12 @@
+// +build !linux
+
+package fsutil
+
+import (
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// removeInheritedACLs is a no-op as POSIX ACLs are only supported on Linux
+func removeInheritedACLs(_ string, _ *types.Stat, _ *XattrFilter) error {
+	return nil
+}
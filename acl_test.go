@@ -0,0 +1,48 @@
+package fsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLText(t *testing.T) {
+	dt, err := ACLFromText("user::rwx,group::r-x,other::r--,mask::rwx,user:1000:r-x,group:50:rw-")
+	require.NoError(t, err)
+
+	s, err := ACLToText(dt)
+	require.NoError(t, err)
+	assert.Equal(t, "user::rwx,user:1000:r-x,group::r-x,group:50:rw-,mask::rwx,other::r--", s)
+
+	// star format with names and ids
+	dt2, err := ACLFromText("user::rwx\nuser:joe:r-x:1000\ngroup::r-x\ngroup:staff:rw-:50 # comment\nmask::rwx\nother::r--")
+	require.NoError(t, err)
+	assert.Equal(t, dt, dt2)
+
+	_, err = ACLFromText("user:joe:r-x")
+	assert.Error(t, err)
+	_, err = ACLToText([]byte{1, 2, 3})
+	assert.Error(t, err)
+}
+
+func TestXattrsFromPAX(t *testing.T) {
+	acl, err := ACLFromText("user::rw-,group::r--,other::r--")
+	require.NoError(t, err)
+	xattrs := map[string][]byte{
+		"user.foo":                []byte("bar"),
+		"system.posix_acl_access": acl,
+	}
+
+	records, err := xattrsToPAX(xattrs)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SCHILY.xattr.user.foo": "bar",
+		"SCHILY.acl.access":     "user::rw-,group::r--,other::r--",
+	}, records)
+
+	records["path"] = "foo"
+	out, err := XattrsFromPAX(records)
+	require.NoError(t, err)
+	assert.Equal(t, xattrs, out)
+}
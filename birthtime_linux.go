@@ -0,0 +1,27 @@
+// +build linux
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sys/unix"
+)
+
+// loadBirthTime sets the birth time with statx(2). It is left unset if the
+// kernel or the filesystem does not report it.
+func loadBirthTime(path string, _ os.FileInfo, stat *types.Stat) error {
+	var stx unix.Statx_t
+	if err := unix.Statx(unix.AT_FDCWD, path, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx); err != nil {
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EPERM) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to statx %s", path)
+	}
+	if stx.Mask&unix.STATX_BTIME != 0 {
+		stat.BirthTime = stx.Btime.Sec*1e9 + int64(stx.Btime.Nsec)
+	}
+	return nil
+}
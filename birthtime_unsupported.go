@@ -0,0 +1,15 @@
+// +build dragonfly openbsd solaris
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// loadBirthTime is a no-op as the birth time is not reported by the
+// platform
+func loadBirthTime(_ string, _ os.FileInfo, _ *types.Stat) error {
+	return nil
+}
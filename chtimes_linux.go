@@ -7,10 +7,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func chtimes(path string, un int64) error {
+func chtimes(path string, atime, mtime int64) error {
 	var utimes [2]unix.Timespec
-	utimes[0] = unix.NsecToTimespec(un)
-	utimes[1] = utimes[0]
+	utimes[0] = unix.NsecToTimespec(atime)
+	utimes[1] = unix.NsecToTimespec(mtime)
 
 	if err := unix.UtimesNanoAt(unix.AT_FDCWD, path, utimes[0:], unix.AT_SYMLINK_NOFOLLOW); err != nil {
 		return errors.Wrap(err, "failed call to UtimesNanoAt")
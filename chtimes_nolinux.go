@@ -9,8 +9,7 @@ import (
 	"github.com/pkg/errors"
 )
 
-func chtimes(path string, un int64) error {
-	mtime := time.Unix(0, un)
+func chtimes(path string, atime, mtime int64) error {
 	fi, err := os.Lstat(path)
 	if err != nil {
 		return errors.WithStack(err)
@@ -18,5 +17,5 @@ func chtimes(path string, un int64) error {
 	if fi.Mode()&os.ModeSymlink != 0 {
 		return nil
 	}
-	return errors.WithStack(os.Chtimes(path, mtime, mtime))
+	return errors.WithStack(os.Chtimes(path, time.Unix(0, atime), time.Unix(0, mtime)))
 }
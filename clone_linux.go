@@ -0,0 +1,15 @@
+// +build linux
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/tonistiigi/fsutil/internal/clone"
+)
+
+// cloneFile shares the data of src with dst. It returns false if the
+// filesystem does not support it.
+func cloneFile(dst, src *os.File) bool {
+	return clone.File(dst, src) == nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package fsutil
+
+import (
+	"os"
+)
+
+func cloneFile(_, _ *os.File) bool {
+	return false
+}
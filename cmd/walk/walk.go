@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -11,6 +12,7 @@ import (
 )
 
 func main() {
+	explain := flag.Bool("explain", false, "print which rule included or excluded every path")
 	flag.Parse()
 	if len(flag.Args()) == 0 {
 		panic("source path not set")
@@ -26,9 +28,23 @@ func main() {
 		excludes = strings.Split(string(dt), "\n")
 	}
 
-	if err := fsutil.Walk(context.Background(), flag.Args()[0], &fsutil.WalkOpt{
+	opt := &fsutil.WalkOpt{
 		ExcludePatterns: excludes,
-	}, func(path string, fi os.FileInfo, err error) error {
+	}
+	if *explain {
+		opt.Trace = func(tr fsutil.FilterTrace) {
+			rule := tr.Rule.String()
+			if tr.Pattern != "" {
+				rule += fmt.Sprintf(" %q", tr.Pattern)
+			}
+			if tr.IgnoreFile != "" {
+				rule += " in " + tr.IgnoreFile
+			}
+			fmt.Printf("%s\t%s\t%s\n", tr.Decision, tr.Path, rule)
+		}
+	}
+
+	if err := fsutil.Walk(context.Background(), flag.Args()[0], opt, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,148 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// ContentStore provides local files for the content digests sent by the
+// sender, so that their data does not need to be requested.
+//
+// The sender does not have to prove that it has the content of a digest,
+// knowing the digest is enough to get the content into the received tree.
+// A store must therefore only hold content that every sender it is used
+// with is allowed to read, e.g. by using a separate store per trust domain.
+type ContentStore interface {
+	// Path returns the path of a file with the content of dgst or an empty
+	// string if the content is not in the store
+	Path(ctx context.Context, dgst digest.Digest) (string, error)
+}
+
+// treeIndex finds the regular files of an existing directory tree by their
+// content digest. Digests are only computed for the files that have the size
+// of the requested content.
+type treeIndex struct {
+	mu     sync.Mutex
+	bySize map[int64][]*indexedFile
+}
+
+type indexedFile struct {
+	path string
+	fi   os.FileInfo
+	dgst digest.Digest
+}
+
+func newTreeIndex(root string) (*treeIndex, error) {
+	t := &treeIndex{bySize: map[int64][]*indexedFile{}}
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() && fi.Size() > 0 {
+			t.bySize[fi.Size()] = append(t.bySize[fi.Size()], &indexedFile{path: p, fi: fi})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to index %s", root)
+	}
+	return t, nil
+}
+
+// lookup returns the path of a file with the content of dgst. Files that
+// changed since they were indexed are ignored.
+func (t *treeIndex) lookup(dgst digest.Digest, size int64) (string, error) {
+	if dgst.Algorithm() != digest.Canonical {
+		return "", nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, f := range t.bySize[size] {
+		if !f.unchanged() {
+			continue
+		}
+		if f.dgst == "" {
+			d, err := digestFile(f.path)
+			if err != nil {
+				if os.IsNotExist(errors.Cause(err)) {
+					continue
+				}
+				return "", err
+			}
+			f.dgst = d
+		}
+		if f.dgst == dgst && f.unchanged() {
+			return f.path, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *indexedFile) unchanged() bool {
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, f.fi) && fi.Size() == f.fi.Size() && fi.ModTime().Equal(f.fi.ModTime())
+}
+
+func digestFile(p string) (digest.Digest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer f.Close()
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	h := digest.Canonical.Hash()
+	if _, err := io.CopyBuffer(h, f, *buf); err != nil {
+		return "", errors.Wrapf(err, "failed to digest %s", p)
+	}
+	return digest.NewDigest(digest.Canonical, h), nil
+}
+
+// copyLocalFile replaces the content of dest with the content of src. The
+// data is shared with a reflink if the filesystem supports it. It returns
+// false and leaves dest empty if the copied data does not match dgst, e.g.
+// because src changed after it was looked up.
+func copyLocalFile(src, dest string, dgst digest.Digest) (bool, error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer s.Close()
+	d, err := os.OpenFile(dest, os.O_RDWR|os.O_TRUNC, 0)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	v := dgst.Verifier()
+	buf := bufPool.Get().(*[]byte)
+	if cloneFile(d, s) {
+		// the clone is verified as src can change while it is cloned
+		_, err = io.CopyBuffer(v, d, *buf)
+	} else {
+		_, err = io.CopyBuffer(io.MultiWriter(d, v), s, *buf)
+	}
+	bufPool.Put(buf)
+	if err != nil {
+		d.Close()
+		return false, errors.Wrapf(err, "failed to copy %s to %s", src, dest)
+	}
+	if !v.Verified() {
+		if err := d.Truncate(0); err != nil {
+			d.Close()
+			return false, errors.WithStack(err)
+		}
+		return false, errors.WithStack(d.Close())
+	}
+	return true, errors.WithStack(d.Close())
+}
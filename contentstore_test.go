@@ -0,0 +1,147 @@
+package fsutil
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+type openRecorder struct {
+	FS
+	mu     sync.Mutex
+	opened []string
+}
+
+func (r *openRecorder) Open(p string) (io.ReadCloser, error) {
+	r.mu.Lock()
+	r.opened = append(r.opened, p)
+	r.mu.Unlock()
+	return r.FS.Open(p)
+}
+
+type mapStore map[digest.Digest]string
+
+func (s mapStore) Path(_ context.Context, dgst digest.Digest) (string, error) {
+	return s[dgst], nil
+}
+
+func TestReceiveContentDigests(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD c file unique",
+		"ADD new dir",
+		"ADD new/a file vendored",
+		"ADD new/b file vendored",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(dest string, opt ReceiveOpt) (*notificationBuffer, []string) {
+		fs := &openRecorder{FS: NewFS(d, nil)}
+		ts := newNotificationBuffer()
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return SendWithOpt(ctx, s1, fs, SendOpt{ContentDigester: FSDigester(NewFS(d, nil))})
+		})
+		eg.Go(func() error {
+			opt.NotifyHashed = ts.HandleChange
+			opt.ContentHasher = simpleSHA256Hasher
+			opt.Filter = func(_ string, s *types.Stat) bool {
+				s.Uid = uint32(os.Getuid())
+				s.Gid = uint32(os.Getgid())
+				return true
+			}
+			return Receive(ctx, s2, dest, opt)
+		})
+		require.NoError(t, eg.Wait())
+		sort.Strings(fs.opened)
+		return ts, fs.opened
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	expected, opened := receive(dest, ReceiveOpt{})
+	assert.Equal(t, []string{"c", "new/a", "new/b"}, opened)
+
+	// renamed and duplicated files are taken from the existing tree
+	dest2, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest2)
+	require.NoError(t, os.MkdirAll(filepath.Join(dest2, "old"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest2, "old/a"), []byte("vendored"), 0600))
+
+	ts, opened := receive(dest2, ReceiveOpt{ReuseExisting: true})
+	assert.Equal(t, []string{"c"}, opened)
+	assert.Equal(t, []string{"c", "new", "new/a", "new/b"}, listFiles(t, dest2))
+	for _, p := range []string{"new/a", "new/b"} {
+		dt, err := ioutil.ReadFile(filepath.Join(dest2, p))
+		require.NoError(t, err)
+		assert.Equal(t, "vendored", string(dt))
+		h, ok := ts.Hash(p)
+		require.True(t, ok)
+		h2, _ := expected.Hash(p)
+		assert.Equal(t, h2, h, p)
+	}
+
+	// content store
+	dgst := digest.FromString("unique")
+	store, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store, dgst.Encoded()), []byte("unique"), 0600))
+
+	dest3, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest3)
+
+	_, opened = receive(dest3, ReceiveOpt{ContentStore: mapStore{dgst: filepath.Join(store, dgst.Encoded())}})
+	assert.Equal(t, []string{"new/a", "new/b"}, opened)
+	dt, err := ioutil.ReadFile(filepath.Join(dest3, "c"))
+	require.NoError(t, err)
+	assert.Equal(t, "unique", string(dt))
+
+	// content that does not match the digest is requested
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store, dgst.Encoded()), []byte("changed content"), 0600))
+
+	dest4, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest4)
+
+	_, opened = receive(dest4, ReceiveOpt{ContentStore: mapStore{dgst: filepath.Join(store, dgst.Encoded())}})
+	assert.Equal(t, []string{"c", "new/a", "new/b"}, opened)
+	dt, err = ioutil.ReadFile(filepath.Join(dest4, "c"))
+	require.NoError(t, err)
+	assert.Equal(t, "unique", string(dt))
+}
+
+func listFiles(t *testing.T, root string) []string {
+	var files []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
@@ -0,0 +1,30 @@
+// +build linux
+
+package fs
+
+import (
+	"github.com/containerd/continuity/sysx"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/sys/unix"
+)
+
+// POSIX ACLs are stored in these xattrs
+const (
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+)
+
+// removeInheritedACLs removes the POSIX ACLs that dst inherited from the
+// default ACL of its parent directory if the source does not have them
+func removeInheritedACLs(dst string, has map[string]struct{}, filter *fsutil.XattrFilter) error {
+	for _, key := range []string{xattrACLAccess, xattrACLDefault} {
+		if _, ok := has[key]; ok || !filter.Match(key) {
+			continue
+		}
+		if err := sysx.LRemovexattr(dst, key); err != nil && !errors.Is(err, sysx.ENODATA) && !errors.Is(err, unix.ENOTSUP) {
+			return errors.Wrapf(err, "failed to remove %s from %s", key, dst)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package fs
+
+import (
+	"github.com/tonistiigi/fsutil"
+)
+
+// removeInheritedACLs is a no-op as POSIX ACLs are only supported on Linux
+func removeInheritedACLs(_ string, _ map[string]struct{}, _ *fsutil.XattrFilter) error {
+	return nil
+}
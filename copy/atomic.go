@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/internal/tmpname"
+)
+
+// stage is an entry copied to path that replaces target on commit
+type stage struct {
+	path       string
+	target     string
+	exists     bool
+	replaceDir bool
+}
+
+// copyStaged copies src to a staging path next to target. It returns false
+// if src is a directory that is merged into an existing one, in which case
+// its contents are staged separately.
+func (c *copier) copyStaged(ctx context.Context, fi os.FileInfo, src, target string) (bool, error) {
+	s := &stage{
+		path:   filepath.Join(filepath.Dir(target), ".tmp."+tmpname.Suffix()),
+		target: target,
+	}
+	st, err := os.Lstat(target)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return false, errors.Wrap(err, "failed to lstat target")
+		}
+	} else {
+		if fi.IsDir() {
+			if st.IsDir() {
+				return false, nil
+			}
+			return false, errors.Errorf("cannot copy to non-directory: %s", target)
+		}
+		policy, err := c.resolveConflict(fi, src, target, st)
+		if err != nil {
+			return false, err
+		}
+		if policy == ConflictSkip {
+			return true, c.skip(target, fi)
+		}
+		s.exists = true
+		s.replaceDir = policy == ConflictReplaceDir
+	}
+
+	c.mu.Lock()
+	c.stages[s.path] = s
+	c.staged = append(c.staged, s)
+	c.mu.Unlock()
+
+	c.staging = true
+	defer func() {
+		c.staging = false
+	}()
+	return true, c.copy(ctx, src, s.path, false)
+}
+
+// commit renames the staged entries into place, applies the metadata of the
+// directories they were merged into and sets the locked inode flags
+func (c *copier) commit() error {
+	for _, s := range c.staged {
+		if s.replaceDir {
+			if err := os.RemoveAll(s.target); err != nil {
+				return errors.Wrapf(err, "failed to remove %s", s.target)
+			}
+		}
+		if err := os.Rename(s.path, s.target); err != nil {
+			return errors.Wrapf(err, "failed to rename %s to %s", s.path, s.target)
+		}
+	}
+	for _, fn := range c.after {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	for _, l := range c.locked {
+		if err := fsutil.SetInodeFlags(l.path, l.flags, fsutil.InodeFlagsLocked, c.inodeFlags); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abort waits for the running copies and removes the staged entries that
+// have not been renamed into place
+func (c *copier) abort() {
+	c.wait(false)
+	for _, s := range c.staged {
+		os.RemoveAll(s.path)
+	}
+}
+
+// finalTarget maps a path under a staging path to its path after commit.
+// c.mu needs to be held.
+func (c *copier) finalTarget(target string, kind fsutil.ChangeKind) (string, fsutil.ChangeKind) {
+	if len(c.stages) == 0 {
+		return target, kind
+	}
+	for p := target; ; {
+		if s, ok := c.stages[p]; ok {
+			if p == target && s.exists {
+				kind = fsutil.ChangeKindModify
+			}
+			return s.target + strings.TrimPrefix(target, p), kind
+		}
+		d := filepath.Dir(p)
+		if d == p {
+			return target, kind
+		}
+		p = d
+	}
+}
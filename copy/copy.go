@@ -8,10 +8,14 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/containerd/continuity/fs"
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
 )
 
 var bufferPool = &sync.Pool{
@@ -67,26 +71,14 @@ func Copy(ctx context.Context, srcRoot, src, dstRoot, dst string, opts ...Opt) e
 	for _, o := range opts {
 		o(&ci)
 	}
-	ensureDstPath := dst
-	if d, f := filepath.Split(dst); f != "" && f != "." {
-		ensureDstPath = d
-	}
-	if ensureDstPath != "" {
-		ensureDstPath, err := fs.RootPath(dstRoot, ensureDstPath)
-		if err != nil {
-			return err
-		}
-		if err := MkdirAll(ensureDstPath, 0755, ci.Chown, ci.Utime); err != nil {
-			return err
-		}
-	}
-
-	dst, err := fs.RootPath(dstRoot, filepath.Clean(dst))
+	dst, err := ensureDst(dstRoot, dst, ci)
 	if err != nil {
 		return err
 	}
 
-	c := newCopier(ci.Chown, ci.Utime, ci.Mode, ci.XAttrErrorHandler)
+	c := newCopier(ci)
+	c.srcRoot = srcRoot
+	c.dstRoot = dstRoot
 	srcs := []string{src}
 
 	if ci.AllowWildcards {
@@ -100,29 +92,71 @@ func Copy(ctx context.Context, srcRoot, src, dstRoot, dst string, opts ...Opt) e
 		srcs = matches
 	}
 
+	ctx = c.setParallelism(ctx, ci.Parallelism)
+
 	for _, src := range srcs {
 		srcFollowed, err := rootPath(srcRoot, src, ci.FollowLinks)
 		if err != nil {
+			c.abort()
 			return err
 		}
 		dst, err := c.prepareTargetDir(srcFollowed, src, dst, ci.CopyDirContents)
 		if err != nil {
+			c.abort()
+			return err
+		}
+		if err := c.setFilter(srcFollowed); err != nil {
+			c.abort()
 			return err
 		}
 		if err := c.copy(ctx, srcFollowed, dst, false); err != nil {
+			c.abort()
 			return err
 		}
 	}
 
+	if err := c.wait(true); err != nil {
+		c.abort()
+		return err
+	}
+	if err := c.commit(); err != nil {
+		c.abort()
+		return err
+	}
+	if c.progressCb != nil {
+		c.progressCb(c.progress, true)
+	}
 	return nil
 }
 
+// ensureDst creates the parent directories of dst and returns its path
+// under dstRoot
+func ensureDst(dstRoot, dst string, ci CopyInfo) (string, error) {
+	ensureDstPath := dst
+	if d, f := filepath.Split(dst); f != "" && f != "." {
+		ensureDstPath = d
+	}
+	if ensureDstPath != "" {
+		ensureDstPath, err := fs.RootPath(dstRoot, ensureDstPath)
+		if err != nil {
+			return "", err
+		}
+		if err := MkdirAll(ensureDstPath, 0755, ci.Chown, ci.Utime); err != nil {
+			return "", err
+		}
+	}
+	return fs.RootPath(dstRoot, filepath.Clean(dst))
+}
+
 func (c *copier) prepareTargetDir(srcFollowed, src, destPath string, copyDirContents bool) (string, error) {
 	fiSrc, err := os.Lstat(srcFollowed)
 	if err != nil {
 		return "", err
 	}
+	return c.prepareTarget(fiSrc, src, destPath, copyDirContents)
+}
 
+func (c *copier) prepareTarget(fiSrc os.FileInfo, src, destPath string, copyDirContents bool) (string, error) {
 	fiDest, err := os.Stat(destPath)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -152,18 +186,153 @@ type User struct {
 
 type Chowner func(*User) (*User, error)
 
+// PathChowner returns the owner for a copied entry. p is the path of the
+// source relative to the source root, with forward slashes.
+type PathChowner func(p string, fi os.FileInfo, old *User) (*User, error)
+
+// PathModer returns the permission bits, including the setuid, setgid and
+// sticky bits, for a copied entry. p is the path of the source relative to
+// the source root, with forward slashes.
+type PathModer func(p string, fi os.FileInfo) (os.FileMode, error)
+
+// XAttrErrorHandler is called if xattrKey can't be copied. Returning nil
+// ignores the error. Calls are serialized.
 type XAttrErrorHandler func(dst, src, xattrKey string, err error) error
 
+// CloneMode controls if file data is cloned with copy-on-write instead of
+// being copied. Cloning uses FICLONE on Linux and clonefile on macOS.
+type CloneMode int
+
+const (
+	// ClonePrefer clones files when the filesystem supports it and copies
+	// the data otherwise
+	ClonePrefer CloneMode = iota
+	// CloneRequire fails the copy if a file can't be cloned
+	CloneRequire
+	// CloneDisable always copies the data
+	CloneDisable
+)
+
+// CopyStrategy is the method that was used to copy the data of a file
+type CopyStrategy int
+
+const (
+	StrategyClone CopyStrategy = iota
+	StrategyCopyFileRange
+	StrategyUserspace
+)
+
+func (s CopyStrategy) String() string {
+	switch s {
+	case StrategyClone:
+		return "clone"
+	case StrategyCopyFileRange:
+		return "copy_file_range"
+	case StrategyUserspace:
+		return "userspace"
+	}
+	return "unknown"
+}
+
+// SocketPolicy controls how sockets are copied
+type SocketPolicy int
+
+const (
+	// SocketSkip leaves sockets out of the copy
+	SocketSkip SocketPolicy = iota
+	// SocketError fails the copy if a socket is found
+	SocketError
+	// SocketPlaceholder creates an unbound socket file with the same
+	// metadata, like `cp -a`
+	SocketPlaceholder
+)
+
+// ConflictPolicy controls what happens when a non-directory source is copied
+// to a path that already exists
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces existing files. Copying over a directory
+	// fails.
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictSkip keeps existing entries
+	ConflictSkip
+	// ConflictNewer replaces existing entries only if the source has a
+	// newer modification time, like `cp -u`
+	ConflictNewer
+	// ConflictFail fails the copy if the target exists
+	ConflictFail
+	// ConflictReplaceDir is ConflictOverwrite that also replaces existing
+	// directories
+	ConflictReplaceDir
+)
+
+// ConflictHandler is called for every target that already exists with the
+// policy applied to it. ConflictNewer is reported as ConflictOverwrite or
+// ConflictSkip.
+type ConflictHandler func(dst, src string, p ConflictPolicy)
+
+// CopyStrategyHandler is called with the strategy used for every copied file
+type CopyStrategyHandler func(dst, src string, s CopyStrategy)
+
 type CopyInfo struct {
 	Chown             Chowner
 	Utime             *time.Time
 	AllowWildcards    bool
 	Mode              *int
 	XAttrErrorHandler XAttrErrorHandler
-	CopyDirContents   bool
-	FollowLinks       bool
+	// XAttrFilter selects the xattrs that are copied
+	XAttrFilter     *fsutil.XattrFilter
+	CopyDirContents bool
+	FollowLinks     bool
+	Clone           CloneMode
+	// CopyStrategyHandler may be called concurrently if Parallelism is set
+	CopyStrategyHandler CopyStrategyHandler
+	// Parallelism is the maximum number of files copied concurrently
+	Parallelism  int
+	SocketPolicy SocketPolicy
+	// IncludePatterns and ExcludePatterns filter the contents of copied
+	// directories with the same semantics as fsutil.WalkOpt. Patterns are
+	// relative to the source directory.
+	IncludePatterns []string
+	ExcludePatterns []string
+	// PathChown and PathMode take precedence over Chown and Mode for the
+	// copied entries. Calls are serialized.
+	PathChown       PathChowner
+	PathMode        PathModer
+	ConflictPolicy  ConflictPolicy
+	ConflictHandler ConflictHandler
+	// LinkFiles hardlinks regular files to the source instead of copying
+	// them, like `cp -al`. Files are copied if the destination is on another
+	// device. Linked files share the metadata of the source so Chown, Mode
+	// and Utime are not applied to them.
+	LinkFiles bool
+	// BreakLinks copies the files that would get a different owner or mode
+	// than the source instead of linking them
+	BreakLinks bool
+	// NotifyCb is called for every created or overwritten entry with its
+	// path relative to the destination root
+	NotifyCb fsutil.ChangeFunc
+	// SkipCb is called for every entry that is not copied because of
+	// SocketPolicy or ConflictPolicy
+	SkipCb SkipFunc
+	// ProgressCb is called with the total number of bytes copied
+	ProgressCb func(int, bool)
+	// Atomic copies new and replaced entries to a temporary path next to
+	// their target and renames them into place after everything has been
+	// copied. Directories that already exist are merged, so their new
+	// entries are renamed individually. Nothing is left behind on error.
+	Atomic bool
+	// InodeFlags controls how the inode flags of regular files and
+	// directories are copied. Immutable and append-only flags are set after
+	// everything has been copied.
+	InodeFlags fsutil.InodeFlagsPolicy
 }
 
+// SkipFunc is called with the path of a skipped entry relative to the
+// destination root. Calls are serialized.
+type SkipFunc func(p string, fi os.FileInfo)
+
 type Opt func(*CopyInfo)
 
 func WithCopyInfo(ci CopyInfo) func(*CopyInfo) {
@@ -190,6 +359,108 @@ func WithXAttrErrorHandler(h XAttrErrorHandler) Opt {
 	}
 }
 
+func WithXAttrFilter(f *fsutil.XattrFilter) Opt {
+	return func(ci *CopyInfo) {
+		ci.XAttrFilter = f
+	}
+}
+
+func WithClone(mode CloneMode) Opt {
+	return func(ci *CopyInfo) {
+		ci.Clone = mode
+	}
+}
+
+func WithCopyStrategyHandler(h CopyStrategyHandler) Opt {
+	return func(ci *CopyInfo) {
+		ci.CopyStrategyHandler = h
+	}
+}
+
+func WithParallelism(n int) Opt {
+	return func(ci *CopyInfo) {
+		ci.Parallelism = n
+	}
+}
+
+func WithSocketPolicy(p SocketPolicy) Opt {
+	return func(ci *CopyInfo) {
+		ci.SocketPolicy = p
+	}
+}
+
+func WithPathChown(fn PathChowner) Opt {
+	return func(ci *CopyInfo) {
+		ci.PathChown = fn
+	}
+}
+
+func WithPathMode(fn PathModer) Opt {
+	return func(ci *CopyInfo) {
+		ci.PathMode = fn
+	}
+}
+
+func WithConflictPolicy(p ConflictPolicy) Opt {
+	return func(ci *CopyInfo) {
+		ci.ConflictPolicy = p
+	}
+}
+
+func WithConflictHandler(h ConflictHandler) Opt {
+	return func(ci *CopyInfo) {
+		ci.ConflictHandler = h
+	}
+}
+
+func WithIncludePatterns(patterns ...string) Opt {
+	return func(ci *CopyInfo) {
+		ci.IncludePatterns = patterns
+	}
+}
+
+func WithExcludePatterns(patterns ...string) Opt {
+	return func(ci *CopyInfo) {
+		ci.ExcludePatterns = patterns
+	}
+}
+
+func WithNotifyCb(fn fsutil.ChangeFunc) Opt {
+	return func(ci *CopyInfo) {
+		ci.NotifyCb = fn
+	}
+}
+
+func WithSkipCb(fn SkipFunc) Opt {
+	return func(ci *CopyInfo) {
+		ci.SkipCb = fn
+	}
+}
+
+func WithProgressCb(fn func(int, bool)) Opt {
+	return func(ci *CopyInfo) {
+		ci.ProgressCb = fn
+	}
+}
+
+func LinkFiles(ci *CopyInfo) {
+	ci.LinkFiles = true
+}
+
+func BreakLinks(ci *CopyInfo) {
+	ci.BreakLinks = true
+}
+
+func Atomic(ci *CopyInfo) {
+	ci.Atomic = true
+}
+
+func WithInodeFlags(p fsutil.InodeFlagsPolicy) Opt {
+	return func(ci *CopyInfo) {
+		ci.InodeFlags = p
+	}
+}
+
 func AllowXAttrErrors(ci *CopyInfo) {
 	h := func(string, string, string, error) error {
 		return nil
@@ -198,20 +469,106 @@ func AllowXAttrErrors(ci *CopyInfo) {
 }
 
 type copier struct {
-	chown             Chowner
-	utime             *time.Time
-	mode              *int
-	inodes            map[uint64]string
-	xattrErrorHandler XAttrErrorHandler
+	chown               Chowner
+	utime               *time.Time
+	mode                *int
+	inodes              map[uint64]string
+	xattrErrorHandler   XAttrErrorHandler
+	xattrFilter         *fsutil.XattrFilter
+	clone               CloneMode
+	copyStrategyHandler CopyStrategyHandler
+	socketPolicy        SocketPolicy
+	includePatterns     []string
+	excludePatterns     []string
+	pathChown           PathChowner
+	pathMode            PathModer
+	conflictPolicy      ConflictPolicy
+	conflictHandler     ConflictHandler
+	linkFiles           bool
+	breakLinks          bool
+	notifyCb            fsutil.ChangeFunc
+	skipCb              SkipFunc
+	progressCb          func(int, bool)
+	atomic              bool
+	inodeFlags          fsutil.InodeFlagsPolicy
+	srcRoot             string
+	dstRoot             string
+
+	// mu serializes the callbacks
+	mu       sync.Mutex
+	progress int
+
+	// filter matches the paths relative to filterRoot against the include
+	// and exclude patterns
+	filter     *fsutil.PathFilter
+	filterRoot string
+
+	// eg runs the file copies in parallel mode. Hardlinks and directory
+	// metadata are deferred until all files have been copied so that links
+	// have a source and directory times are not changed by later writes.
+	eg       *errgroup.Group
+	sem      chan struct{}
+	deferred []func() error
+
+	// staging is set while an entry is copied to its staging path in
+	// atomic mode. stages maps the staging paths to the stages and after
+	// holds the metadata changes of merged directories that have to wait
+	// for the renames.
+	staging bool
+	stages  map[string]*stage
+	staged  []*stage
+	after   []func() error
+
+	// moved are the copied sources that Move removes on success
+	move  bool
+	moved []movedEntry
+
+	// locked are the targets that get immutable or append-only flags on
+	// commit
+	locked []lockedFile
 }
 
-func newCopier(chown Chowner, tm *time.Time, mode *int, xeh XAttrErrorHandler) *copier {
-	if xeh == nil {
-		xeh = func(dst, src, key string, err error) error {
-			return err
+type lockedFile struct {
+	path  string
+	flags uint32
+}
+
+func newCopier(ci CopyInfo) *copier {
+	c := &copier{
+		inodes:              map[uint64]string{},
+		chown:               ci.Chown,
+		utime:               ci.Utime,
+		xattrFilter:         ci.XAttrFilter,
+		mode:                ci.Mode,
+		clone:               ci.Clone,
+		copyStrategyHandler: ci.CopyStrategyHandler,
+		socketPolicy:        ci.SocketPolicy,
+		includePatterns:     ci.IncludePatterns,
+		excludePatterns:     ci.ExcludePatterns,
+		pathChown:           ci.PathChown,
+		pathMode:            ci.PathMode,
+		conflictPolicy:      ci.ConflictPolicy,
+		conflictHandler:     ci.ConflictHandler,
+		linkFiles:           ci.LinkFiles,
+		breakLinks:          ci.BreakLinks,
+		notifyCb:            ci.NotifyCb,
+		skipCb:              ci.SkipCb,
+		progressCb:          ci.ProgressCb,
+		atomic:              ci.Atomic,
+		inodeFlags:          ci.InodeFlags,
+		stages:              map[string]*stage{},
+	}
+	c.xattrErrorHandler = func(dst, src, key string, err error) error {
+		return err
+	}
+	if xeh := ci.XAttrErrorHandler; xeh != nil {
+		c.xattrErrorHandler = func(dst, src, key string, err error) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return xeh(dst, src, key, err)
 		}
 	}
-	return &copier{inodes: map[uint64]string{}, chown: chown, utime: tm, xattrErrorHandler: xeh, mode: mode}
+	return c
 }
 
 // dest is always clean
@@ -226,32 +583,100 @@ func (c *copier) copy(ctx context.Context, src, target string, overwriteTargetMe
 		return errors.Wrapf(err, "failed to stat %s", src)
 	}
 
+	if (fi.Mode() & os.ModeSocket) == os.ModeSocket {
+		switch c.socketPolicy {
+		case SocketSkip:
+			return c.skip(target, fi)
+		case SocketError:
+			return errors.Errorf("cannot copy socket %s", src)
+		}
+	}
+
+	if c.atomic && !c.staging {
+		if staged, err := c.copyStaged(ctx, fi, src, target); staged || err != nil {
+			return err
+		}
+	}
+
+	kind := fsutil.ChangeKindAdd
 	if !fi.IsDir() {
-		if err := ensureEmptyFileTarget(target); err != nil {
+		exists, skip, err := c.ensureEmptyFileTarget(fi, src, target)
+		if err != nil {
 			return err
 		}
+		if exists {
+			kind = fsutil.ChangeKindModify
+		}
+		if skip {
+			return c.skip(target, fi)
+		}
+	}
+	if c.move {
+		c.moved = append(c.moved, movedEntry{src: src, fi: fi})
 	}
 
 	copyFileInfo := true
 
 	switch {
 	case fi.IsDir():
-		if created, err := c.copyDirectory(ctx, src, target, fi, overwriteTargetMetadata); err != nil {
+		created, err := c.copyDirectory(ctx, src, target, fi, overwriteTargetMetadata)
+		if err != nil {
 			return err
-		} else if !overwriteTargetMetadata {
+		}
+		if !created {
+			kind = fsutil.ChangeKindModify
+		}
+		if !overwriteTargetMetadata {
 			copyFileInfo = created
 		}
 	case (fi.Mode() & os.ModeType) == 0:
+		if c.linkFiles {
+			linked, err := c.linkFile(fi, src, target)
+			if err != nil {
+				return err
+			}
+			if linked {
+				// the link shares the metadata of the source
+				return c.notify(kind, target, fi)
+			}
+		}
 		link, err := getLinkSource(target, fi, c.inodes)
 		if err != nil {
 			return errors.Wrap(err, "failed to get hardlink")
 		}
+		if c.eg != nil {
+			if link != "" {
+				c.deferred = append(c.deferred, func() error {
+					if err := os.Link(link, target); err != nil {
+						return errors.Wrap(err, "failed to create hard link")
+					}
+					if err := c.copyMetadata(fi, src, target); err != nil {
+						return err
+					}
+					return c.notify(kind, target, fi)
+				})
+				return nil
+			}
+			return c.goCopy(ctx, func() error {
+				if err := c.copyFile(src, target); err != nil {
+					return err
+				}
+				if err := c.copyMetadata(fi, src, target); err != nil {
+					return err
+				}
+				c.addProgress(fi.Size())
+				return c.notify(kind, target, fi)
+			})
+		}
 		if link != "" {
 			if err := os.Link(link, target); err != nil {
 				return errors.Wrap(err, "failed to create hard link")
 			}
-		} else if err := copyFile(src, target); err != nil {
-			return errors.Wrap(err, "failed to copy files")
+		} else {
+			if err := c.copyFile(src, target); err != nil {
+				return err
+			}
+			c.addProgress(fi.Size())
 		}
 	case (fi.Mode() & os.ModeSymlink) == os.ModeSymlink:
 		link, err := os.Readlink(src)
@@ -265,18 +690,322 @@ func (c *copier) copy(ctx context.Context, src, target string, overwriteTargetMe
 		if err := copyDevice(target, fi); err != nil {
 			return errors.Wrapf(err, "failed to create device")
 		}
+	case (fi.Mode() & os.ModeNamedPipe) == os.ModeNamedPipe:
+		if err := copyFifo(target, fi); err != nil {
+			return errors.Wrapf(err, "failed to create fifo")
+		}
+	case (fi.Mode() & os.ModeSocket) == os.ModeSocket:
+		if err := copySocket(target, fi); err != nil {
+			return errors.Wrapf(err, "failed to create socket")
+		}
 	default:
-		// TODO: Support pipes and sockets
-		return errors.Wrapf(err, "unsupported mode %s", fi.Mode())
+		return errors.Errorf("unsupported mode %s", fi.Mode())
 	}
 
-	if copyFileInfo {
-		if err := c.copyFileInfo(fi, target); err != nil {
-			return errors.Wrap(err, "failed to copy file info")
+	if !copyFileInfo {
+		return nil
+	}
+	if fi.IsDir() && (c.eg != nil || c.atomic && !c.staging) {
+		fn := func() error {
+			if err := c.copyMetadata(fi, src, target); err != nil {
+				return err
+			}
+			return c.notify(kind, target, fi)
+		}
+		if c.atomic && !c.staging {
+			// renaming the staged entries changes the directory times
+			c.after = append(c.after, fn)
+		} else {
+			c.deferred = append(c.deferred, fn)
+		}
+		return nil
+	}
+	if err := c.copyMetadata(fi, src, target); err != nil {
+		return err
+	}
+	return c.notify(kind, target, fi)
+}
+
+// notify reports a copied entry. Calls are serialized.
+func (c *copier) notify(kind fsutil.ChangeKind, target string, fi os.FileInfo) error {
+	if c.notifyCb == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target, kind = c.finalTarget(target, kind)
+	p, err := rel(c.dstRoot, target)
+	if err != nil {
+		return err
+	}
+	return c.notifyCb(kind, p, fi, nil)
+}
+
+// skip reports an entry that was not copied. Calls are serialized.
+func (c *copier) skip(target string, fi os.FileInfo) error {
+	if c.skipCb == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target, _ = c.finalTarget(target, fsutil.ChangeKindAdd)
+	p, err := rel(c.dstRoot, target)
+	if err != nil {
+		return err
+	}
+	c.skipCb(p, fi)
+	return nil
+}
+
+func (c *copier) addProgress(n int64) {
+	if c.progressCb == nil {
+		return
+	}
+	c.mu.Lock()
+	c.progress += int(n)
+	c.progressCb(c.progress, false)
+	c.mu.Unlock()
+}
+
+func (c *copier) copyFile(src, target string) error {
+	if c.inodeFlags != fsutil.InodeFlagsSkip {
+		flags, err := fsutil.GetInodeFlags(src)
+		if err != nil {
+			return err
+		}
+		// flags are only reported on Linux. The target is not created
+		// before the copy otherwise as clonefile(2) needs a new target.
+		if flags&fsutil.InodeFlagsData != 0 {
+			if err := c.prepareFile(target, flags); err != nil {
+				return err
+			}
+		}
+	}
+	s, err := copyFile(src, target, c.clone)
+	if err != nil {
+		return errors.Wrap(err, "failed to copy files")
+	}
+	if c.copyStrategyHandler != nil {
+		c.copyStrategyHandler(target, src, s)
+	}
+	return nil
+}
+
+// linkFile hardlinks target to src. It returns false if the file needs to be
+// copied instead.
+func (c *copier) linkFile(fi os.FileInfo, src, target string) (bool, error) {
+	if c.breakLinks {
+		overridden, err := c.metadataOverridden(fi, src)
+		if err != nil || overridden {
+			return false, err
+		}
+	}
+	if err := os.Link(src, target); err != nil {
+		if errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.EMLINK) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "failed to create hard link")
+	}
+	return true, nil
+}
+
+// metadataOverridden returns true if the copy of src would get a different
+// owner or mode than the source
+func (c *copier) metadataOverridden(fi os.FileInfo, src string) (bool, error) {
+	m, err := c.modeFor(src, fi)
+	if err != nil {
+		return false, err
+	}
+	if m != fi.Mode() {
+		return true, nil
+	}
+	if chown := c.chownerFor(src, fi); chown != nil {
+		uid, gid := getOwner(fi)
+		u, err := chown(&User{UID: uid, GID: gid})
+		if err != nil {
+			return false, errors.WithStack(err)
+		}
+		if u != nil && (u.UID != uid || u.GID != gid) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+const permMask = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// chownerFor returns the Chowner for the copy of src. Calls to the callbacks
+// are serialized.
+func (c *copier) chownerFor(src string, fi os.FileInfo) Chowner {
+	if c.pathChown == nil {
+		if c.chown == nil {
+			return nil
+		}
+		return func(old *User) (*User, error) {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.chown(old)
+		}
+	}
+	return func(old *User) (*User, error) {
+		p, err := c.relPath(src)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.pathChown(p, fi, old)
+	}
+}
+
+// modeFor returns the mode for the copy of src
+func (c *copier) modeFor(src string, fi os.FileInfo) (os.FileMode, error) {
+	m := fi.Mode()
+	if c.pathMode != nil {
+		p, err := c.relPath(src)
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		perm, err := c.pathMode(p, fi)
+		c.mu.Unlock()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		return (m &^ permMask) | (perm & permMask), nil
+	}
+	if c.mode != nil {
+		m = (m & ^os.FileMode(0777)) | os.FileMode(*c.mode&0777)
+	}
+	return m, nil
+}
+
+func (c *copier) relPath(src string) (string, error) {
+	p, err := rel(c.srcRoot, src)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(p), nil
+}
+
+func (c *copier) copyMetadata(fi os.FileInfo, src, target string) error {
+	if err := c.copyFileInfo(fi, src, target); err != nil {
+		return errors.Wrap(err, "failed to copy file info")
+	}
+
+	// xattrs are set last as chown clears security.capability
+	if st, ok := fi.Sys().(*types.Stat); ok {
+		if err := setXAttrs(target, src, st.Xattrs, c.xattrFilter, c.xattrErrorHandler); err != nil {
+			return errors.Wrap(err, "failed to set xattrs")
+		}
+	} else if err := copyXAttrs(target, src, c.xattrFilter, c.xattrErrorHandler); err != nil {
+		return errors.Wrap(err, "failed to copy xattrs")
+	}
+
+	// an access ACL sets the group permission bits from its mask, so a
+	// changed mode needs to be applied again
+	if (c.mode != nil || c.pathMode != nil) && fi.Mode()&os.ModeSymlink == 0 {
+		m, err := c.modeFor(src, fi)
+		if err != nil {
+			return err
+		}
+		if m != fi.Mode() {
+			if err := os.Chmod(target, m); err != nil {
+				return errors.Wrapf(err, "failed to chmod %s", target)
+			}
 		}
+	}
+
+	if c.inodeFlags != fsutil.InodeFlagsSkip && (fi.Mode().IsRegular() || fi.IsDir()) {
+		return c.copyInodeFlags(fi, src, target)
+	}
+	return nil
+}
+
+// prepareFile creates target with the inode flags that need to be set
+// before the data is written
+func (c *copier) prepareFile(target string, flags uint32) error {
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", target)
+	}
+	f.Close()
+	return fsutil.SetInodeFlags(target, flags, fsutil.InodeFlagsData, c.inodeFlags)
+}
 
-		if err := copyXAttrs(target, src, c.xattrErrorHandler); err != nil {
-			return errors.Wrap(err, "failed to copy xattrs")
+// copyInodeFlags sets the inode flags of the source on target. The locked
+// flags are set by commit.
+func (c *copier) copyInodeFlags(fi os.FileInfo, src, target string) error {
+	var flags uint32
+	if st, ok := fi.Sys().(*types.Stat); ok {
+		flags = st.Flags
+	} else {
+		var err error
+		if flags, err = fsutil.GetInodeFlags(src); err != nil {
+			return err
+		}
+	}
+	if err := fsutil.SetInodeFlags(target, flags, fsutil.InodeFlagsMask&^fsutil.InodeFlagsLocked, c.inodeFlags); err != nil {
+		return err
+	}
+	if flags&fsutil.InodeFlagsLocked != 0 {
+		c.mu.Lock()
+		target, _ = c.finalTarget(target, fsutil.ChangeKindAdd)
+		c.locked = append(c.locked, lockedFile{path: target, flags: flags})
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// getOwner returns the owner of fi, which can also come from a fsutil.FS
+func getOwner(fi os.FileInfo) (uid, gid int) {
+	if st, ok := fi.Sys().(*types.Stat); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return getUIDGID(fi)
+}
+
+// setParallelism enables parallel copies if n is greater than one
+func (c *copier) setParallelism(ctx context.Context, n int) context.Context {
+	if n <= 1 {
+		return ctx
+	}
+	var eg *errgroup.Group
+	eg, ctx = errgroup.WithContext(ctx)
+	c.eg = eg
+	c.sem = make(chan struct{}, n)
+	return ctx
+}
+
+// goCopy runs fn in the background once one of the parallel slots is free
+func (c *copier) goCopy(ctx context.Context, fn func() error) error {
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.eg.Go(func() error {
+		defer func() { <-c.sem }()
+		return fn()
+	})
+	return nil
+}
+
+// wait waits for the background copies and then runs the deferred
+// operations in order if finish is set
+func (c *copier) wait(finish bool) error {
+	if c.eg == nil {
+		return nil
+	}
+	if err := c.eg.Wait(); err != nil {
+		return err
+	}
+	if !finish {
+		return nil
+	}
+	for _, fn := range c.deferred {
+		if err := fn(); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -311,7 +1040,19 @@ func (c *copier) copyDirectory(ctx context.Context, src, dst string, stat os.Fil
 	}
 
 	for _, fi := range fis {
-		if err := c.copy(ctx, filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name()), true); err != nil {
+		p := filepath.Join(src, fi.Name())
+		if c.filter != nil {
+			rel, err := rel(c.filterRoot, p)
+			if err != nil {
+				return false, err
+			}
+			if ok, err := c.filter.Match(rel, fi.IsDir()); err != nil {
+				return false, err
+			} else if !ok {
+				continue
+			}
+		}
+		if err := c.copy(ctx, p, filepath.Join(dst, fi.Name()), true); err != nil {
 			return false, err
 		}
 	}
@@ -319,18 +1060,81 @@ func (c *copier) copyDirectory(ctx context.Context, src, dst string, stat os.Fil
 	return created, nil
 }
 
-func ensureEmptyFileTarget(dst string) error {
-	fi, err := os.Lstat(dst)
+// setFilter sets up matching the include and exclude patterns for the
+// entries under a source directory. The patterns have the same semantics as
+// in fsutil.WalkOpt and are matched while the directory is copied.
+func (c *copier) setFilter(root string) error {
+	c.filter = nil
+	if len(c.includePatterns) == 0 && len(c.excludePatterns) == 0 {
+		return nil
+	}
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stat %s", root)
+	}
+	if !fi.IsDir() {
+		return nil
+	}
+	filter, err := fsutil.NewPathFilter(c.includePatterns, c.excludePatterns)
+	if err != nil {
+		return err
+	}
+	c.filter = filter
+	c.filterRoot = root
+	return nil
+}
+
+// ensureEmptyFileTarget removes an existing dst according to the conflict
+// policy. It returns if dst exists and if the copy of src should be skipped.
+func (c *copier) ensureEmptyFileTarget(fi os.FileInfo, src, dst string) (exists, skip bool, err error) {
+	st, err := os.Lstat(dst)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil
+			return false, false, nil
 		}
-		return errors.Wrap(err, "failed to lstat file target")
+		return false, false, errors.Wrap(err, "failed to lstat file target")
+	}
+
+	policy, err := c.resolveConflict(fi, src, dst, st)
+	if err != nil {
+		return true, false, err
+	}
+	switch policy {
+	case ConflictSkip:
+		return true, true, nil
+	case ConflictReplaceDir:
+		return true, false, errors.Wrapf(os.RemoveAll(dst), "failed to remove %s", dst)
+	}
+	return true, false, os.Remove(dst)
+}
+
+// resolveConflict returns the policy for replacing the existing dst with
+// src. It fails if the policy does not allow replacing dst.
+func (c *copier) resolveConflict(fi os.FileInfo, src, dst string, st os.FileInfo) (ConflictPolicy, error) {
+	policy := ConflictOverwrite
+	switch c.conflictPolicy {
+	case ConflictSkip:
+		policy = ConflictSkip
+	case ConflictNewer:
+		if !fi.ModTime().After(st.ModTime()) {
+			policy = ConflictSkip
+		}
+	case ConflictFail:
+		policy = ConflictFail
+	}
+	if policy == ConflictOverwrite && st.IsDir() {
+		if c.conflictPolicy != ConflictReplaceDir {
+			return 0, errors.Errorf("cannot replace to directory %s with file", dst)
+		}
+		policy = ConflictReplaceDir
+	}
+	if c.conflictHandler != nil {
+		c.conflictHandler(dst, src, policy)
 	}
-	if fi.IsDir() {
-		return errors.Errorf("cannot replace to directory %s with file", dst)
+	if policy == ConflictFail {
+		return 0, errors.Wrapf(os.ErrExist, "failed to copy %s to %s", src, dst)
 	}
-	return os.Remove(dst)
+	return policy, nil
 }
 
 func containsWildcards(name string) bool {
@@ -10,33 +10,38 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func copyFile(source, target string) error {
-	if err := unix.Clonefileat(unix.AT_FDCWD, source, unix.AT_FDCWD, target, unix.CLONE_NOFOLLOW); err != nil {
-		if err != unix.EINVAL {
-			return err
+func copyFile(source, target string, clone CloneMode) (CopyStrategy, error) {
+	if clone != CloneDisable {
+		if err := unix.Clonefileat(unix.AT_FDCWD, source, unix.AT_FDCWD, target, unix.CLONE_NOFOLLOW); err != nil {
+			if clone == CloneRequire {
+				return 0, errors.Wrapf(err, "failed to clone %s", source)
+			}
+			if err != unix.EINVAL && err != unix.ENOTSUP && err != unix.EXDEV {
+				return 0, err
+			}
+		} else {
+			return StrategyClone, nil
 		}
-	} else {
-		return nil
 	}
 
 	src, err := os.Open(source)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open source %s", source)
+		return 0, errors.Wrapf(err, "failed to open source %s", source)
 	}
 	defer src.Close()
 	tgt, err := os.Create(target)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open target %s", target)
+		return 0, errors.Wrapf(err, "failed to open target %s", target)
 	}
 	defer tgt.Close()
 
 	return copyFileContent(tgt, src)
 }
 
-func copyFileContent(dst, src *os.File) error {
+func copyFileContent(dst, src *os.File) (CopyStrategy, error) {
 	buf := bufferPool.Get().(*[]byte)
 	_, err := io.CopyBuffer(dst, src, *buf)
 	bufferPool.Put(buf)
 
-	return err
+	return StrategyUserspace, err
 }
@@ -7,6 +7,9 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/internal/clone"
+	"github.com/tonistiigi/fsutil/internal/sparse"
+	"github.com/tonistiigi/fsutil/types"
 	"golang.org/x/sys/unix"
 )
 
@@ -15,11 +18,9 @@ func getUIDGID(fi os.FileInfo) (uid, gid int) {
 	return int(st.Uid), int(st.Gid)
 }
 
-func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
-	st := fi.Sys().(*syscall.Stat_t)
-
-	chown := c.chown
-	uid, gid := getUIDGID(fi)
+func (c *copier) copyFileInfo(fi os.FileInfo, src, name string) error {
+	chown := c.chownerFor(src, fi)
+	uid, gid := getOwner(fi)
 	old := &User{UID: uid, GID: gid}
 	if chown == nil {
 		chown = func(u *User) (*User, error) {
@@ -30,9 +31,9 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 		return errors.Wrapf(err, "failed to chown %s", name)
 	}
 
-	m := fi.Mode()
-	if c.mode != nil {
-		m = (m & ^os.FileMode(0777)) | os.FileMode(*c.mode&0777)
+	m, err := c.modeFor(src, fi)
+	if err != nil {
+		return err
 	}
 	if (fi.Mode() & os.ModeSymlink) != os.ModeSymlink {
 		if err := os.Chmod(name, m); err != nil {
@@ -45,7 +46,15 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 			return err
 		}
 	} else {
-		timespec := []unix.Timespec{unix.Timespec(StatAtime(st)), unix.Timespec(StatMtime(st))}
+		var timespec []unix.Timespec
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			timespec = []unix.Timespec{unix.Timespec(StatAtime(st)), unix.Timespec(StatMtime(st))}
+		} else if st, ok := fi.Sys().(*types.Stat); ok && st.AccessTime != 0 {
+			timespec = []unix.Timespec{unix.NsecToTimespec(st.AccessTime), unix.NsecToTimespec(st.ModTime)}
+		} else {
+			mtime := unix.NsecToTimespec(fi.ModTime().UnixNano())
+			timespec = []unix.Timespec{mtime, mtime}
+		}
 		if err := unix.UtimesNanoAt(unix.AT_FDCWD, name, timespec, unix.AT_SYMLINK_NOFOLLOW); err != nil {
 			return errors.Wrapf(err, "failed to utime %s", name)
 		}
@@ -54,25 +63,40 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 	return nil
 }
 
-func copyFile(source, target string) error {
+func copyFile(source, target string, mode CloneMode) (CopyStrategy, error) {
 	src, err := os.Open(source)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open source %s", source)
+		return 0, errors.Wrapf(err, "failed to open source %s", source)
 	}
 	defer src.Close()
 	tgt, err := os.Create(target)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open target %s", target)
+		return 0, errors.Wrapf(err, "failed to open target %s", target)
 	}
 	defer tgt.Close()
 
+	if mode != CloneDisable {
+		err := clone.File(tgt, src)
+		if err == nil {
+			return StrategyClone, nil
+		}
+		if mode == CloneRequire {
+			os.Remove(target)
+			return 0, errors.Wrapf(err, "failed to clone %s", source)
+		}
+	}
+
 	return copyFileContent(tgt, src)
 }
 
-func copyFileContent(dst, src *os.File) error {
+func copyFileContent(dst, src *os.File) (CopyStrategy, error) {
 	st, err := src.Stat()
 	if err != nil {
-		return errors.Wrap(err, "unable to stat source")
+		return 0, errors.Wrap(err, "unable to stat source")
+	}
+
+	if ok, s, err := copySparse(dst, src, st); ok || err != nil {
+		return s, err
 	}
 
 	var written int64
@@ -90,19 +114,69 @@ func copyFileContent(dst, src *os.File) error {
 		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, desired, 0)
 		if err != nil {
 			if (err != unix.ENOSYS && err != unix.EXDEV && err != unix.EPERM) || !first {
-				return errors.Wrap(err, "copy file range failed")
+				return 0, errors.Wrap(err, "copy file range failed")
 			}
 
 			buf := bufferPool.Get().(*[]byte)
 			_, err = io.CopyBuffer(dst, src, *buf)
 			bufferPool.Put(buf)
-			return errors.Wrap(err, "userspace copy failed")
+			return StrategyUserspace, errors.Wrap(err, "userspace copy failed")
 		}
 
 		first = false
 		written += int64(n)
 	}
-	return nil
+	return StrategyCopyFileRange, nil
+}
+
+// copySparse copies only the data regions of src and recreates the holes
+// by truncating dst to the size of src. It returns false if src has no holes
+// or they can't be detected.
+func copySparse(dst, src *os.File, fi os.FileInfo) (bool, CopyStrategy, error) {
+	extents, err := sparse.DataExtents(src, fi)
+	if err != nil || extents == nil {
+		return err != nil, 0, err
+	}
+	strategy := StrategyCopyFileRange
+	for _, e := range extents {
+		s, err := copyRange(dst, src, e.Offset, e.Length)
+		if err != nil {
+			return true, 0, err
+		}
+		if s == StrategyUserspace {
+			strategy = s
+		}
+	}
+	return true, strategy, errors.Wrap(dst.Truncate(fi.Size()), "failed to truncate")
+}
+
+// copyRange copies length bytes at offset from src to the same offset in dst
+func copyRange(dst, src *os.File, offset, length int64) (CopyStrategy, error) {
+	roff, woff := offset, offset
+	for length > 0 {
+		desired := length
+		if desired > math.MaxInt32 {
+			desired = math.MaxInt32
+		}
+		n, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(desired), 0)
+		if err != nil {
+			if err != unix.ENOSYS && err != unix.EXDEV && err != unix.EPERM {
+				return 0, errors.Wrap(err, "copy file range failed")
+			}
+			if _, err := dst.Seek(woff, io.SeekStart); err != nil {
+				return 0, errors.Wrap(err, "failed to seek")
+			}
+			buf := bufferPool.Get().(*[]byte)
+			_, err = io.CopyBuffer(dst, io.NewSectionReader(src, roff, length), *buf)
+			bufferPool.Put(buf)
+			return StrategyUserspace, errors.Wrap(err, "userspace copy failed")
+		}
+		if n == 0 {
+			return 0, errors.Wrap(io.ErrUnexpectedEOF, "copy file range failed")
+		}
+		length -= int64(n)
+	}
+	return StrategyCopyFileRange, nil
 }
 
 func copyDevice(dst string, fi os.FileInfo) error {
@@ -0,0 +1,296 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containerd/continuity/fs/fstest"
+	"github.com/containerd/continuity/sysx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/internal/sparse"
+	"golang.org/x/sys/unix"
+)
+
+func TestCopySparseFile(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	f, err := os.Create(filepath.Join(t1, "foo"))
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(4<<20))
+	data := bytes.Repeat([]byte("data"), 1024)
+	_, err = f.WriteAt(data, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	if !sparse.IsSparse(mustStat(t, filepath.Join(t1, "foo"))) {
+		t.Skip("filesystem does not support sparse files")
+	}
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Copy(context.TODO(), t1, "foo", t2, "foo")
+	require.NoError(t, err)
+
+	dt, err := ioutil.ReadFile(filepath.Join(t2, "foo"))
+	require.NoError(t, err)
+	expected := make([]byte, 4<<20)
+	copy(expected[1<<20:], data)
+	require.True(t, bytes.Equal(expected, dt))
+
+	fi := mustStat(t, filepath.Join(t2, "foo"))
+	require.True(t, fi.Sys().(*syscall.Stat_t).Blocks*512 < fi.Size())
+}
+
+func TestCopyFifoAndSocket(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateFile("foo.txt", []byte("contents"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+	require.NoError(t, unix.Mkfifo(filepath.Join(t1, "fifo"), 0600))
+	require.NoError(t, unix.Mknod(filepath.Join(t1, "sock"), unix.S_IFSOCK|0700, 0))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Copy(context.TODO(), t1, "/", t2, "/")
+	require.NoError(t, err)
+	fi := mustStat(t, filepath.Join(t2, "fifo"))
+	require.Equal(t, os.ModeNamedPipe|0600, fi.Mode())
+	_, err = os.Lstat(filepath.Join(t2, "sock"))
+	require.True(t, os.IsNotExist(err))
+
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	err = Copy(context.TODO(), t1, "/", t3, "/", WithSocketPolicy(SocketError))
+	require.Error(t, err)
+
+	t4, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t4)
+
+	err = Copy(context.TODO(), t1, "/", t4, "/", WithSocketPolicy(SocketPlaceholder))
+	require.NoError(t, err)
+	require.NoError(t, fstest.CheckDirectoryEqual(t1, t4))
+	fi, err = os.Lstat(filepath.Join(t4, "sock"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket|0700, fi.Mode())
+}
+
+func TestCopyXAttrFilter(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	p := filepath.Join(t1, "foo")
+	require.NoError(t, ioutil.WriteFile(p, []byte("foo"), 0644))
+	if err := sysx.LSetxattr(p, "user.keep", []byte("1"), 0); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	require.NoError(t, sysx.LSetxattr(p, "user.drop", []byte("2"), 0))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	f := &fsutil.XattrFilter{Include: []string{"user.*"}, Exclude: []string{"user.drop"}}
+	require.NoError(t, Copy(context.TODO(), t1, "foo", t2, "copy", WithXAttrFilter(f)))
+	require.NoError(t, CopyFS(context.TODO(), fsutil.NewFS(t1, nil), "foo", t2, "copyfs", WithXAttrFilter(f)))
+
+	// the filter applies when the source could be renamed
+	require.NoError(t, Move(context.TODO(), t1, "foo", t2, "move", WithXAttrFilter(f)))
+
+	for _, name := range []string{"copy", "copyfs", "move"} {
+		keys, err := sysx.LListxattr(filepath.Join(t2, name))
+		require.NoError(t, err)
+		require.Equal(t, []string{"user.keep"}, keys)
+	}
+}
+
+func TestMoveSockets(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/foo.txt", []byte("contents"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+	require.NoError(t, unix.Mknod(filepath.Join(t1, "src/sock"), unix.S_IFSOCK|0700, 0))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	// skipped sockets are reported and left in the source
+	var skipped []string
+	err = Move(context.TODO(), t1, "src", t2, "dst", WithSkipCb(func(p string, fi os.FileInfo) {
+		skipped = append(skipped, p)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join("dst", "sock")}, skipped)
+	require.Equal(t, []string{"src", "src/sock"}, listFiles(t, t1))
+	require.Equal(t, []string{"dst", "dst/foo.txt"}, listFiles(t, t2))
+
+	require.Error(t, Move(context.TODO(), t1, "src", t2, "dst2", WithSocketPolicy(SocketError)))
+	require.Equal(t, []string{"src", "src/sock"}, listFiles(t, t1))
+
+	require.NoError(t, Move(context.TODO(), t1, "src", t2, "dst3", WithSocketPolicy(SocketPlaceholder)))
+	require.Equal(t, []string(nil), listFiles(t, t1))
+	fi, err := os.Lstat(filepath.Join(t2, "dst3/sock"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket|0700, fi.Mode())
+}
+
+func TestCopyCapabilities(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	// revision 2 with the effective flag and CAP_NET_RAW permitted
+	caps := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	p := filepath.Join(t1, "ping")
+	require.NoError(t, ioutil.WriteFile(p, []byte("ping"), 0755))
+	if err := os.Chown(p, 1, 1); err != nil {
+		t.Skipf("chown not permitted: %v", err)
+	}
+	if err := sysx.LSetxattr(p, "security.capability", caps, 0); err != nil {
+		t.Skipf("capabilities not supported: %v", err)
+	}
+	caps, err = sysx.LGetxattr(p, "security.capability")
+	require.NoError(t, err)
+
+	p = filepath.Join(t1, "suid")
+	require.NoError(t, ioutil.WriteFile(p, []byte("suid"), 0755))
+	require.NoError(t, os.Chmod(p, os.ModeSetuid|os.ModeSetgid|0755))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	require.NoError(t, Copy(context.TODO(), t1, "/", t2, "/", WithChown(2, 2)))
+
+	dt, err := sysx.LGetxattr(filepath.Join(t2, "ping"), "security.capability")
+	require.NoError(t, err)
+	require.Equal(t, caps, dt)
+
+	fi := mustStat(t, filepath.Join(t2, "suid"))
+	require.Equal(t, os.ModeSetuid|os.ModeSetgid|0755, fi.Mode())
+	require.Equal(t, uint32(2), fi.Sys().(*syscall.Stat_t).Uid)
+}
+
+func TestCopyACL(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	acl, err := fsutil.ACLFromText("user::rwx,user:1000:rwx,group::r-x,mask::rwx,other::r-x")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(t1, "cache"), 0755))
+	if err := sysx.LSetxattr(filepath.Join(t1, "cache"), xattrACLDefault, acl, 0); err != nil {
+		t.Skipf("acls not supported: %v", err)
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(t1, "cache/foo"), []byte("foo"), 0644))
+	fooACL, err := sysx.LGetxattr(filepath.Join(t1, "cache/foo"), xattrACLAccess)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(t1, "bar"), []byte("bar"), 0644))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+	require.NoError(t, sysx.LSetxattr(t2, xattrACLDefault, acl, 0))
+
+	require.NoError(t, Copy(context.TODO(), t1, "/", t2, "/"))
+
+	dt, err := sysx.LGetxattr(filepath.Join(t2, "cache"), xattrACLDefault)
+	require.NoError(t, err)
+	require.Equal(t, acl, dt)
+	dt, err = sysx.LGetxattr(filepath.Join(t2, "cache/foo"), xattrACLAccess)
+	require.NoError(t, err)
+	require.Equal(t, fooACL, dt)
+	_, err = sysx.LGetxattr(filepath.Join(t2, "bar"), xattrACLAccess)
+	require.True(t, errors.Is(err, sysx.ENODATA), "%v", err)
+
+	// the mode override also applies to the acl mask
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	mode := 0600
+	require.NoError(t, Copy(context.TODO(), t1, "cache/foo", t3, "foo", WithCopyInfo(CopyInfo{Mode: &mode})))
+	require.Equal(t, os.FileMode(0600), mustStat(t, filepath.Join(t3, "foo")).Mode())
+}
+
+func TestCopyInodeFlags(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting immutable flags requires root")
+	}
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/foo", []byte("foo"), 0644),
+		fstest.CreateDir("src/sub", 0755),
+		fstest.CreateFile("src/sub/bar", []byte("bar"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	unlock := func(p string) {
+		fsutil.SetInodeFlags(p, 0, fsutil.InodeFlagsLocked, fsutil.InodeFlagsIgnoreUnsupported)
+	}
+	if err := fsutil.SetInodeFlags(filepath.Join(t1, "src/foo"), fsutil.InodeFlagNoDump, fsutil.InodeFlagsMask, fsutil.InodeFlagsRequire); err != nil {
+		t.Skipf("inode flags not supported: %v", err)
+	}
+	require.NoError(t, fsutil.SetInodeFlags(filepath.Join(t1, "src/sub"), fsutil.InodeFlagImmutable, fsutil.InodeFlagsMask, fsutil.InodeFlagsRequire))
+	defer unlock(filepath.Join(t1, "src/sub"))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	opt := WithInodeFlags(fsutil.InodeFlagsRequire)
+	require.NoError(t, Copy(context.TODO(), t1, "src", t2, "copy", opt, Atomic))
+	defer unlock(filepath.Join(t2, "copy/sub"))
+	require.NoError(t, CopyFS(context.TODO(), fsutil.NewFS(t1, &fsutil.WalkOpt{InodeFlags: true}), "src", t2, "copyfs", opt))
+	defer unlock(filepath.Join(t2, "copyfs/sub"))
+	require.NoError(t, Copy(context.TODO(), t1, "src", t2, "noflags"))
+
+	for _, name := range []string{"copy", "copyfs", "noflags"} {
+		expected := map[string]uint32{"foo": fsutil.InodeFlagNoDump, "sub": fsutil.InodeFlagImmutable, "sub/bar": 0}
+		if name == "noflags" {
+			expected = map[string]uint32{"foo": 0, "sub": 0, "sub/bar": 0}
+		}
+		for p, flags := range expected {
+			f, err := fsutil.GetInodeFlags(filepath.Join(t2, name, p))
+			require.NoError(t, err)
+			require.Equal(t, flags, f, "%s/%s", name, p)
+		}
+	}
+}
+
+func mustStat(t *testing.T, p string) os.FileInfo {
+	fi, err := os.Stat(p)
+	require.NoError(t, err)
+	return fi
+}
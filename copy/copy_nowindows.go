@@ -3,26 +3,77 @@
 package fs
 
 import (
+	"os"
+
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sys/unix"
 
 	"github.com/containerd/continuity/sysx"
 )
 
-// copyXAttrs requires xeh to be non-nil
-func copyXAttrs(dst, src string, xeh XAttrErrorHandler) error {
+// copyXAttrs copies the xattrs passing filter and requires xeh to be non-nil
+func copyXAttrs(dst, src string, filter *fsutil.XattrFilter, xeh XAttrErrorHandler) error {
 	xattrKeys, err := sysx.LListxattr(src)
 	if err != nil {
 		return xeh(dst, src, "", errors.Wrapf(err, "failed to list xattrs on %s", src))
 	}
+	has := map[string]struct{}{}
 	for _, xattr := range xattrKeys {
+		has[xattr] = struct{}{}
+		if !filter.Match(xattr) {
+			continue
+		}
 		data, err := sysx.LGetxattr(src, xattr)
 		if err != nil {
-			return xeh(dst, src, xattr, errors.Wrapf(err, "failed to get xattr %q on %s", xattr, src))
+			if err := xeh(dst, src, xattr, errors.Wrapf(err, "failed to get xattr %q on %s", xattr, src)); err != nil {
+				return err
+			}
+			continue
 		}
 		if err := sysx.LSetxattr(dst, xattr, data, 0); err != nil {
-			return xeh(dst, src, xattr, errors.Wrapf(err, "failed to set xattr %q on %s", xattr, dst))
+			if err := xeh(dst, src, xattr, errors.Wrapf(err, "failed to set xattr %q on %s", xattr, dst)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return removeInheritedACLs(dst, has, filter)
+}
+
+func copyFifo(dst string, fi os.FileInfo) error {
+	return unix.Mkfifo(dst, uint32(fi.Mode().Perm()))
+}
+
+// copySocket creates an unbound socket file as a placeholder for the socket
+func copySocket(dst string, fi os.FileInfo) error {
+	return unix.Mknod(dst, unix.S_IFSOCK|uint32(fi.Mode().Perm()), 0)
+}
+
+// setXAttrs requires xeh to be non-nil
+func setXAttrs(dst, src string, xattrs map[string][]byte, filter *fsutil.XattrFilter, xeh XAttrErrorHandler) error {
+	has := map[string]struct{}{}
+	for k, v := range xattrs {
+		has[k] = struct{}{}
+		if !filter.Match(k) {
+			continue
+		}
+		if err := sysx.LSetxattr(dst, k, v, 0); err != nil {
+			if err := xeh(dst, src, k, errors.Wrapf(err, "failed to set xattr %q on %s", k, dst)); err != nil {
+				return err
+			}
 		}
 	}
+	return removeInheritedACLs(dst, has, filter)
+}
 
-	return nil
+func copyDeviceStat(dst string, fi os.FileInfo, st *types.Stat) error {
+	mode := uint32(fi.Mode().Perm())
+	if fi.Mode()&os.ModeCharDevice != 0 {
+		mode |= unix.S_IFCHR
+	} else {
+		mode |= unix.S_IFBLK
+	}
+	return unix.Mknod(dst, mode, int(unix.Mkdev(uint32(st.Devmajor), uint32(st.Devminor))))
 }
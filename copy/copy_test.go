@@ -3,14 +3,19 @@ package fs
 import (
 	"context"
 	_ "crypto/sha256"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/containerd/continuity/fs/fstest"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil"
+	fstypes "github.com/tonistiigi/fsutil/types"
 )
 
 // TODO: Create copy directory which requires privilege
@@ -329,6 +334,603 @@ func TestCopySymlinks(t *testing.T) {
 	require.Equal(t, "foo.txt", link)
 }
 
+func TestCopyCloneStrategy(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateFile("foo.txt", []byte("contents"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	var strategies []CopyStrategy
+	h := func(dst, src string, s CopyStrategy) {
+		require.Equal(t, filepath.Join(t2, "foo.txt"), dst)
+		strategies = append(strategies, s)
+	}
+
+	err = Copy(context.TODO(), t1, "foo.txt", t2, "foo.txt", WithClone(CloneDisable), WithCopyStrategyHandler(h))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(strategies))
+	require.NotEqual(t, StrategyClone, strategies[0])
+
+	err = Copy(context.TODO(), t1, "foo.txt", t2, "foo.txt", WithClone(CloneRequire), WithCopyStrategyHandler(h))
+	if err != nil {
+		// filesystem does not support cloning
+		require.Equal(t, 1, len(strategies))
+	} else {
+		require.Equal(t, 2, len(strategies))
+		require.Equal(t, StrategyClone, strategies[1])
+	}
+
+	err = Copy(context.TODO(), t1, "foo.txt", t2, "foo.txt", WithCopyStrategyHandler(h))
+	require.NoError(t, err)
+	require.NoError(t, fstest.CheckDirectoryEqual(t1, t2))
+}
+
+func TestCopyParallel(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	tm := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var appliers []fstest.Applier
+	for _, d := range []string{"a", "a/b", "c"} {
+		appliers = append(appliers, fstest.CreateDir(d, 0755))
+		for i := 0; i < 20; i++ {
+			appliers = append(appliers, fstest.CreateRandomFile(fmt.Sprintf("%s/f%d", d, i), int64(i), 64*1024, 0644))
+		}
+	}
+	appliers = append(appliers,
+		fstest.Link("a/f1", "a/b/link1"),
+		fstest.Link("a/f1", "c/link2"),
+		fstest.Symlink("../a", "c/sym"),
+		fstest.Chtimes("a/b", tm, tm),
+		fstest.Chtimes("a", tm, tm),
+	)
+	require.NoError(t, fstest.Apply(appliers...).Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Copy(context.TODO(), t1, "/", t2, "/", WithParallelism(4))
+	require.NoError(t, err)
+	require.NoError(t, fstest.CheckDirectoryEqual(t1, t2))
+
+	for _, d := range []string{"a", "a/b"} {
+		fi, err := os.Stat(filepath.Join(t2, d))
+		require.NoError(t, err)
+		require.True(t, tm.Equal(fi.ModTime()), "%s: %v != %v", d, tm, fi.ModTime())
+	}
+}
+
+func TestCopyPatterns(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/foo.txt", []byte("foo"), 0644),
+		fstest.CreateFile("src/bar.log", []byte("bar"), 0644),
+		fstest.CreateFile("src/keep.log", []byte("keep"), 0644),
+		fstest.CreateDir("src/node_modules", 0755),
+		fstest.CreateFile("src/node_modules/mod.js", []byte("mod"), 0644),
+		fstest.CreateDir("src/sub", 0755),
+		fstest.CreateFile("src/sub/baz.txt", []byte("baz"), 0644),
+		fstest.CreateFile("src/sub/baz.go", []byte("baz"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Copy(context.TODO(), t1, "src", t2, "dst", WithExcludePatterns("*.log", "!keep.log", "node_modules"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo.txt", "keep.log", "sub", "sub/baz.go", "sub/baz.txt"}, listFiles(t, filepath.Join(t2, "dst")))
+
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	err = Copy(context.TODO(), t1, "src", t3, "dst", WithIncludePatterns("**/*.txt"), WithExcludePatterns("sub/baz.txt"))
+	require.NoError(t, err)
+	// directories that could contain matches are created like in fsutil.Walk
+	require.Equal(t, []string{"foo.txt", "node_modules", "sub"}, listFiles(t, filepath.Join(t3, "dst")))
+}
+
+func TestCopyPathChownAndMode(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateDir("src/bin", 0755),
+		fstest.CreateFile("src/bin/run.sh", []byte("run"), 0644),
+		fstest.CreateDir("src/data", 0755),
+		fstest.CreateFile("src/data/foo.txt", []byte("foo"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	var paths []string
+	chown := func(p string, fi os.FileInfo, old *User) (*User, error) {
+		paths = append(paths, p)
+		if strings.HasPrefix(p, "src/data") {
+			return &User{UID: 1, GID: 2}, nil
+		}
+		return old, nil
+	}
+	mode := func(p string, fi os.FileInfo) (os.FileMode, error) {
+		if fi.IsDir() {
+			return fi.Mode().Perm(), nil
+		}
+		if strings.HasPrefix(p, "src/bin/") {
+			return 0755, nil
+		}
+		return 0600, nil
+	}
+	// the callbacks don't need to be safe for concurrent use
+	err = Copy(context.TODO(), t1, "src", t2, "dst", WithPathChown(chown), WithPathMode(mode), WithParallelism(4))
+	if err != nil && os.Getuid() != 0 {
+		t.Skip("chown requires root")
+	}
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"src", "src/bin", "src/bin/run.sh", "src/data", "src/data/foo.txt"}, paths)
+
+	for p, expected := range map[string]os.FileMode{
+		"dst/bin":          os.ModeDir | 0755,
+		"dst/bin/run.sh":   0755,
+		"dst/data":         os.ModeDir | 0755,
+		"dst/data/foo.txt": 0600,
+	} {
+		st, err := os.Lstat(filepath.Join(t2, p))
+		require.NoError(t, err)
+		require.Equal(t, expected, st.Mode(), p)
+		uid, gid := getUIDGID(st)
+		if strings.HasPrefix(p, "dst/data") {
+			require.Equal(t, 1, uid)
+			require.Equal(t, 2, gid)
+		} else {
+			require.Equal(t, os.Getuid(), uid)
+		}
+	}
+}
+
+func TestCopyConflictPolicy(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	now := time.Now().Truncate(time.Second)
+	apply := fstest.Apply(
+		fstest.CreateFile("old.txt", []byte("src-old"), 0644),
+		fstest.CreateFile("new.txt", []byte("src-new"), 0644),
+		fstest.CreateFile("dir", []byte("src-dir"), 0644),
+		fstest.Chtimes("old.txt", now, now),
+		fstest.Chtimes("new.txt", now, now),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	setup := func() string {
+		t2, err := ioutil.TempDir("", "test")
+		require.NoError(t, err)
+		apply := fstest.Apply(
+			fstest.CreateFile("old.txt", []byte("dst-old"), 0644),
+			fstest.CreateFile("new.txt", []byte("dst-new"), 0644),
+			fstest.CreateDir("dir", 0755),
+			fstest.Chtimes("old.txt", now.Add(-time.Hour), now.Add(-time.Hour)),
+			fstest.Chtimes("new.txt", now.Add(time.Hour), now.Add(time.Hour)),
+		)
+		require.NoError(t, apply.Apply(t2))
+		return t2
+	}
+
+	readFile := func(p string) string {
+		dt, err := ioutil.ReadFile(p)
+		require.NoError(t, err)
+		return string(dt)
+	}
+
+	t2 := setup()
+	defer os.RemoveAll(t2)
+	err = Copy(context.TODO(), t1, "/", t2, "/")
+	require.Error(t, err)
+
+	t3 := setup()
+	defer os.RemoveAll(t3)
+	err = Copy(context.TODO(), t1, "/", t3, "/", WithConflictPolicy(ConflictSkip))
+	require.NoError(t, err)
+	require.Equal(t, "dst-old", readFile(filepath.Join(t3, "old.txt")))
+	require.Equal(t, "dst-new", readFile(filepath.Join(t3, "new.txt")))
+
+	t4 := setup()
+	defer os.RemoveAll(t4)
+	policies := map[string]ConflictPolicy{}
+	h := func(dst, src string, p ConflictPolicy) {
+		policies[filepath.Base(dst)] = p
+	}
+	err = Copy(context.TODO(), t1, "/", t4, "/", WithConflictPolicy(ConflictNewer), WithConflictHandler(h))
+	require.NoError(t, err)
+	require.Equal(t, "src-old", readFile(filepath.Join(t4, "old.txt")))
+	require.Equal(t, "dst-new", readFile(filepath.Join(t4, "new.txt")))
+	require.Equal(t, map[string]ConflictPolicy{
+		"dir":     ConflictSkip,
+		"old.txt": ConflictOverwrite,
+		"new.txt": ConflictSkip,
+	}, policies)
+
+	t5 := setup()
+	defer os.RemoveAll(t5)
+	err = Copy(context.TODO(), t1, "/", t5, "/", WithConflictPolicy(ConflictFail))
+	require.True(t, errors.Is(err, os.ErrExist))
+
+	t6 := setup()
+	defer os.RemoveAll(t6)
+	err = Copy(context.TODO(), t1, "/", t6, "/", WithConflictPolicy(ConflictReplaceDir))
+	require.NoError(t, err)
+	require.NoError(t, fstest.CheckDirectoryEqual(t1, t6))
+}
+
+func TestCopyLinkFiles(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/foo.txt", []byte("foo"), 0644),
+		fstest.CreateFile("src/run.sh", []byte("run"), 0644),
+		fstest.Symlink("foo.txt", "src/link"),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	sameFile := func(p1, p2 string) bool {
+		fi1, err := os.Lstat(p1)
+		require.NoError(t, err)
+		fi2, err := os.Lstat(p2)
+		require.NoError(t, err)
+		return os.SameFile(fi1, fi2)
+	}
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Copy(context.TODO(), t1, "src", t2, "dst", LinkFiles)
+	require.NoError(t, err)
+	require.NoError(t, fstest.CheckDirectoryEqual(filepath.Join(t1, "src"), filepath.Join(t2, "dst")))
+	require.True(t, sameFile(filepath.Join(t1, "src/foo.txt"), filepath.Join(t2, "dst/foo.txt")))
+	require.True(t, sameFile(filepath.Join(t1, "src/run.sh"), filepath.Join(t2, "dst/run.sh")))
+	require.False(t, sameFile(filepath.Join(t1, "src/link"), filepath.Join(t2, "dst/link")))
+
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	mode := func(p string, fi os.FileInfo) (os.FileMode, error) {
+		if strings.HasSuffix(p, ".sh") {
+			return 0755, nil
+		}
+		return fi.Mode().Perm(), nil
+	}
+	err = Copy(context.TODO(), t1, "src", t3, "dst", LinkFiles, BreakLinks, WithPathMode(mode))
+	require.NoError(t, err)
+	require.True(t, sameFile(filepath.Join(t1, "src/foo.txt"), filepath.Join(t3, "dst/foo.txt")))
+	require.False(t, sameFile(filepath.Join(t1, "src/run.sh"), filepath.Join(t3, "dst/run.sh")))
+
+	fi, err := os.Stat(filepath.Join(t3, "dst/run.sh"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), fi.Mode())
+	fi, err = os.Stat(filepath.Join(t1, "src/run.sh"))
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0644), fi.Mode())
+}
+
+func TestCopyNotify(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateFile("foo.txt", []byte("foo"), 0644),
+		fstest.CreateFile("bar.txt", []byte("bar-data"), 0644),
+		fstest.CreateFile("baz.txt", []byte("baz"), 0644),
+		fstest.CreateDir("sub", 0755),
+		fstest.Symlink("../foo.txt", "sub/link"),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	tm := time.Now().Add(time.Hour)
+	apply = fstest.Apply(
+		fstest.CreateFile("foo.txt", []byte("old"), 0644),
+		fstest.CreateFile("baz.txt", []byte("new"), 0644),
+		fstest.Chtimes("foo.txt", tm.Add(-2*time.Hour), tm.Add(-2*time.Hour)),
+		fstest.Chtimes("baz.txt", tm, tm),
+	)
+	require.NoError(t, apply.Apply(t2))
+
+	changes := map[string]string{}
+	// the same callback works for fsutil.Receive
+	notify := func(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		changes[filepath.ToSlash(p)] = map[fsutil.ChangeKind]string{
+			fsutil.ChangeKindAdd:    "add",
+			fsutil.ChangeKindModify: "modify",
+		}[kind]
+		return nil
+	}
+	skip := func(p string, fi os.FileInfo) {
+		changes[filepath.ToSlash(p)] = "skipped"
+	}
+	var progress []int
+	var last bool
+	progressCb := func(n int, l bool) {
+		progress = append(progress, n)
+		last = l
+	}
+
+	err = Copy(context.TODO(), t1, "/", t2, "/", WithConflictPolicy(ConflictNewer), WithNotifyCb(notify), WithSkipCb(skip), WithProgressCb(progressCb))
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]string{
+		"bar.txt":  "add",
+		"baz.txt":  "skipped",
+		"foo.txt":  "modify",
+		"sub":      "add",
+		"sub/link": "add",
+	}, changes)
+	require.True(t, last)
+	require.Equal(t, 11, progress[len(progress)-1])
+}
+
+func TestCopyAtomic(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/a", []byte("new"), 0644),
+		fstest.CreateDir("src/sub", 0755),
+		fstest.CreateFile("src/sub/b", []byte("b"), 0644),
+		fstest.CreateFile("src/sub/c", []byte("c"), 0644),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	apply = fstest.Apply(
+		fstest.CreateDir("dst", 0755),
+		fstest.CreateFile("dst/a", []byte("old"), 0644),
+		fstest.CreateFile("dst/keep", []byte("keep"), 0644),
+	)
+	require.NoError(t, apply.Apply(t2))
+
+	changes := map[string]fsutil.ChangeKind{}
+	notify := func(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+		if p == filepath.FromSlash("dst/sub/c") {
+			return errors.New("fail")
+		}
+		changes[filepath.ToSlash(p)] = kind
+		return nil
+	}
+	err = Copy(context.TODO(), t1, "src", t2, "dst", WithCopyInfo(CopyInfo{CopyDirContents: true, Atomic: true}), WithNotifyCb(notify))
+	require.EqualError(t, err, "fail")
+	require.Equal(t, []string{"dst", "dst/a", "dst/keep"}, listFiles(t, t2))
+	dt, err := ioutil.ReadFile(filepath.Join(t2, "dst/a"))
+	require.NoError(t, err)
+	require.Equal(t, "old", string(dt))
+
+	notify = func(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+		changes[filepath.ToSlash(p)] = kind
+		return nil
+	}
+	changes = map[string]fsutil.ChangeKind{}
+	err = Copy(context.TODO(), t1, "src", t2, "dst", WithCopyInfo(CopyInfo{CopyDirContents: true, Atomic: true, Parallelism: 2}), WithNotifyCb(notify))
+	require.NoError(t, err)
+	require.Equal(t, []string{"dst", "dst/a", "dst/keep", "dst/sub", "dst/sub/b", "dst/sub/c"}, listFiles(t, t2))
+	dt, err = ioutil.ReadFile(filepath.Join(t2, "dst/a"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(dt))
+	require.Equal(t, map[string]fsutil.ChangeKind{
+		"dst/a":     fsutil.ChangeKindModify,
+		"dst/sub":   fsutil.ChangeKindAdd,
+		"dst/sub/b": fsutil.ChangeKindAdd,
+		"dst/sub/c": fsutil.ChangeKindAdd,
+	}, changes)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	err = Copy(ctx, t1, "src/a", t2, "single", Atomic)
+	require.Equal(t, context.Canceled, errors.Cause(err))
+	require.Equal(t, []string{"dst", "dst/a", "dst/keep", "dst/sub", "dst/sub/b", "dst/sub/c"}, listFiles(t, t2))
+}
+
+func TestMove(t *testing.T) {
+	apply := fstest.Apply(
+		fstest.CreateDir("src", 0755),
+		fstest.CreateFile("src/foo.txt", []byte("foo"), 0644),
+		fstest.Link("src/foo.txt", "src/link"),
+		fstest.CreateDir("src/sub", 0700),
+		fstest.CreateFile("src/sub/bar.log", []byte("bar"), 0600),
+		fstest.Symlink("../foo.txt", "src/sub/sym"),
+	)
+
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+	require.NoError(t, apply.Apply(t1))
+
+	expected, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(expected)
+	require.NoError(t, apply.Apply(expected))
+
+	t2, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t2)
+
+	err = Move(context.TODO(), t1, "src", t2, "src")
+	require.NoError(t, err)
+	require.Equal(t, []string(nil), listFiles(t, t1))
+	require.NoError(t, fstest.CheckDirectoryEqual(expected, t2))
+
+	// chown can't be applied by a rename so the files are copied
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	err = Move(context.TODO(), t2, "src", t3, "dst", WithChown(1, 2), WithExcludePatterns("**/*.log"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"src", "src/sub", "src/sub/bar.log"}, listFiles(t, t2))
+	require.Equal(t, []string{"dst", "dst/foo.txt", "dst/link", "dst/sub", "dst/sub/sym"}, listFiles(t, t3))
+
+	st1, err := os.Lstat(filepath.Join(t3, "dst/foo.txt"))
+	require.NoError(t, err)
+	st2, err := os.Lstat(filepath.Join(t3, "dst/link"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(st1, st2))
+	uid, gid := getUIDGID(st1)
+	require.Equal(t, 1, uid)
+	require.Equal(t, 2, gid)
+
+	// sources that change during the copy are kept
+	notify := func(kind fsutil.ChangeKind, p string, fi os.FileInfo, err error) error {
+		if p == filepath.FromSlash("moved/bar.log") {
+			return ioutil.WriteFile(filepath.Join(t2, "src/sub/bar.log"), []byte("changed"), 0600)
+		}
+		return nil
+	}
+	err = Move(context.TODO(), t2, "src/sub", t3, "moved", WithChown(1, 2), WithNotifyCb(notify))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "changed during move")
+	require.Equal(t, []string{"src", "src/sub", "src/sub/bar.log"}, listFiles(t, t2))
+}
+
+func TestCopyFS(t *testing.T) {
+	t1, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t1)
+
+	tm := time.Now().Add(-time.Hour).Truncate(time.Second)
+	atm := time.Now().Add(time.Hour).Truncate(time.Second)
+	apply := fstest.Apply(
+		fstest.CreateDir("a", 0755),
+		fstest.CreateDir("a/b", 0700),
+		fstest.CreateFile("a/foo.txt", []byte("foo"), 0644),
+		fstest.CreateFile("a/b/bar.txt", []byte("bar"), 0600),
+		fstest.Link("a/foo.txt", "a/b/link"),
+		fstest.Symlink("../foo.txt", "a/b/sym"),
+		fstest.CreateDir("c", 0755),
+		fstest.CreateFile("c/baz.log", []byte("baz"), 0644),
+		fstest.Chtimes("a/b/bar.txt", atm, tm),
+		fstest.Chtimes("a/b", tm, tm),
+		fstest.Chtimes("a", tm, tm),
+	)
+	require.NoError(t, apply.Apply(t1))
+
+	for _, parallelism := range []int{0, 4} {
+		t2, err := ioutil.TempDir("", "test")
+		require.NoError(t, err)
+		defer os.RemoveAll(t2)
+
+		err = CopyFS(context.TODO(), fsutil.NewFS(t1, &fsutil.WalkOpt{ExtendedStat: true}), "/", t2, "/", WithParallelism(parallelism))
+		require.NoError(t, err)
+		require.NoError(t, fstest.CheckDirectoryEqual(t1, t2))
+
+		fi, err := os.Stat(filepath.Join(t2, "a"))
+		require.NoError(t, err)
+		require.True(t, tm.Equal(fi.ModTime()), "%v != %v", tm, fi.ModTime())
+
+		var atime int64
+		err = fsutil.Walk(context.TODO(), filepath.Join(t2, "a/b"), &fsutil.WalkOpt{ExtendedStat: true}, func(p string, fi os.FileInfo, err error) error {
+			if err == nil && p == "bar.txt" {
+				atime = fi.Sys().(*fstypes.Stat).AccessTime
+			}
+			return err
+		})
+		require.NoError(t, err)
+		require.Equal(t, atm.UnixNano(), atime)
+	}
+
+	t3, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t3)
+
+	err = CopyFS(context.TODO(), fsutil.NewFS(t1, nil), "a/*.txt", t3, "dst/", AllowWildcards)
+	require.NoError(t, err)
+	err = CopyFS(context.TODO(), fsutil.NewFS(t1, nil), "c", t3, "dst", WithChown(1, 2))
+	require.NoError(t, err)
+	require.Equal(t, []string{"dst", "dst/c", "dst/c/baz.log", "dst/foo.txt"}, listFiles(t, t3))
+
+	st, err := os.Lstat(filepath.Join(t3, "dst/c/baz.log"))
+	require.NoError(t, err)
+	uid, gid := getUIDGID(st)
+	require.Equal(t, 1, uid)
+	require.Equal(t, 2, gid)
+
+	err = CopyFS(context.TODO(), fsutil.NewFS(t1, nil), "a/*.go", t3, "dst", AllowWildcards)
+	require.EqualError(t, err, "no matches found: a/*.go")
+	err = CopyFS(context.TODO(), fsutil.NewFS(t1, nil), "missing", t3, "dst")
+	require.True(t, errors.Is(err, os.ErrNotExist))
+
+	sub, err := fsutil.SubDirFS([]fsutil.Dir{{
+		Stat: fstypes.Stat{Path: "sub", Mode: uint32(os.ModeDir | 0755)},
+		FS:   fsutil.NewFS(filepath.Join(t1, "a"), nil),
+	}})
+	require.NoError(t, err)
+
+	t4, err := ioutil.TempDir("", "test")
+	require.NoError(t, err)
+	defer os.RemoveAll(t4)
+
+	err = CopyFS(context.TODO(), sub, "sub/b", t4, "/", WithCopyInfo(CopyInfo{CopyDirContents: true}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar.txt", "link", "sym"}, listFiles(t, t4))
+	dt, err := ioutil.ReadFile(filepath.Join(t4, "link"))
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(dt))
+}
+
+func listFiles(t *testing.T, root string) []string {
+	var out []string
+	err := filepath.Walk(root, func(p string, _ os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root {
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			out = append(out, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return out
+}
+
 func testCopy(apply fstest.Applier) error {
 	t1, err := ioutil.TempDir("", "test-copy-src-")
 	if err != nil {
@@ -7,6 +7,7 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
 	"golang.org/x/sys/unix"
 )
 
@@ -15,10 +16,9 @@ func getUIDGID(fi os.FileInfo) (uid, gid int) {
 	return int(st.Uid), int(st.Gid)
 }
 
-func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
-	st := fi.Sys().(*syscall.Stat_t)
-	chown := c.chown
-	uid, gid := getUIDGID(fi)
+func (c *copier) copyFileInfo(fi os.FileInfo, src, name string) error {
+	chown := c.chownerFor(src, fi)
+	uid, gid := getOwner(fi)
 	old := &User{UID: uid, GID: gid}
 	if chown == nil {
 		chown = func(u *User) (*User, error) {
@@ -29,9 +29,9 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 		return errors.Wrapf(err, "failed to chown %s", name)
 	}
 
-	m := fi.Mode()
-	if c.mode != nil {
-		m = (m & ^os.FileMode(0777)) | os.FileMode(*c.mode&0777)
+	m, err := c.modeFor(src, fi)
+	if err != nil {
+		return err
 	}
 	if (fi.Mode() & os.ModeSymlink) != os.ModeSymlink {
 		if err := os.Chmod(name, m); err != nil {
@@ -44,7 +44,15 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 			return err
 		}
 	} else {
-		timespec := []unix.Timespec{unix.Timespec(StatAtime(st)), unix.Timespec(StatMtime(st))}
+		var timespec []unix.Timespec
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			timespec = []unix.Timespec{unix.Timespec(StatAtime(st)), unix.Timespec(StatMtime(st))}
+		} else if st, ok := fi.Sys().(*types.Stat); ok && st.AccessTime != 0 {
+			timespec = []unix.Timespec{unix.NsecToTimespec(st.AccessTime), unix.NsecToTimespec(st.ModTime)}
+		} else {
+			mtime := unix.NsecToTimespec(fi.ModTime().UnixNano())
+			timespec = []unix.Timespec{mtime, mtime}
+		}
 		if err := unix.UtimesNanoAt(unix.AT_FDCWD, name, timespec, unix.AT_SYMLINK_NOFOLLOW); err != nil {
 			return errors.Wrapf(err, "failed to utime %s", name)
 		}
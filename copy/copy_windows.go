@@ -5,10 +5,20 @@ import (
 	"os"
 
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
 )
 
-func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
-	if err := os.Chmod(name, fi.Mode()); err != nil {
+func getUIDGID(fi os.FileInfo) (uid, gid int) {
+	return 0, 0
+}
+
+func (c *copier) copyFileInfo(fi os.FileInfo, src, name string) error {
+	m, err := c.modeFor(src, fi)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(name, m); err != nil {
 		return errors.Wrapf(err, "failed to chmod %s", name)
 	}
 
@@ -17,32 +27,51 @@ func (c *copier) copyFileInfo(fi os.FileInfo, name string) error {
 	return nil
 }
 
-func copyFile(source, target string) error {
+func copyFile(source, target string, clone CloneMode) (CopyStrategy, error) {
+	if clone == CloneRequire {
+		return 0, errors.Errorf("failed to clone %s: cloning is not supported", source)
+	}
 	src, err := os.Open(source)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open source %s", source)
+		return 0, errors.Wrapf(err, "failed to open source %s", source)
 	}
 	defer src.Close()
 	tgt, err := os.Create(target)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open target %s", target)
+		return 0, errors.Wrapf(err, "failed to open target %s", target)
 	}
 	defer tgt.Close()
 
 	return copyFileContent(tgt, src)
 }
 
-func copyFileContent(dst, src *os.File) error {
+func copyFileContent(dst, src *os.File) (CopyStrategy, error) {
 	buf := bufferPool.Get().(*[]byte)
 	_, err := io.CopyBuffer(dst, src, *buf)
 	bufferPool.Put(buf)
-	return err
+	return StrategyUserspace, err
 }
 
-func copyXAttrs(dst, src string, xeh XAttrErrorHandler) error {
+func copyXAttrs(dst, src string, filter *fsutil.XattrFilter, xeh XAttrErrorHandler) error {
 	return nil
 }
 
 func copyDevice(dst string, fi os.FileInfo) error {
 	return errors.New("device copy not supported")
 }
+
+func copyDeviceStat(dst string, fi os.FileInfo, st *types.Stat) error {
+	return errors.New("device copy not supported")
+}
+
+func setXAttrs(dst, src string, xattrs map[string][]byte, filter *fsutil.XattrFilter, xeh XAttrErrorHandler) error {
+	return nil
+}
+
+func copyFifo(dst string, fi os.FileInfo) error {
+	return errors.New("fifo copy not supported")
+}
+
+func copySocket(dst string, fi os.FileInfo) error {
+	return errors.New("socket copy not supported")
+}
@@ -0,0 +1,408 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// CopyFS copies src from srcFS to dst under dstRoot with the same semantics
+// as Copy. src is a path inside srcFS and may contain wildcards if
+// AllowWildcards is set. Hardlinks are recreated from the Linkname of the
+// walked entries. Include and exclude patterns are not supported, filter
+// srcFS instead. FollowLinks and LinkFiles are ignored.
+func CopyFS(ctx context.Context, srcFS fsutil.FS, src, dstRoot, dst string, opts ...Opt) error {
+	var ci CopyInfo
+	for _, o := range opts {
+		o(&ci)
+	}
+	if len(ci.IncludePatterns) > 0 || len(ci.ExcludePatterns) > 0 {
+		return errors.New("include and exclude patterns are not supported when copying from FS")
+	}
+	if ci.Clone == CloneRequire {
+		return errors.New("cloning is not supported when copying from FS")
+	}
+	if ci.Atomic {
+		return errors.New("atomic copies are not supported when copying from FS")
+	}
+
+	dst, err := ensureDst(dstRoot, dst, ci)
+	if err != nil {
+		return err
+	}
+
+	c := newCopier(ci)
+	// paths passed to the callbacks are the FS paths
+	c.srcRoot = "."
+	c.dstRoot = dstRoot
+	ctx = c.setParallelism(ctx, ci.Parallelism)
+
+	fc := &fsCopier{
+		copier:          c,
+		fs:              srcFS,
+		dst:             dst,
+		copyDirContents: ci.CopyDirContents,
+		links:           map[string]string{},
+	}
+	fc.setSource(src, ci.AllowWildcards)
+
+	if err := fc.run(ctx); err != nil {
+		c.abort()
+		return err
+	}
+	if !fc.matched {
+		c.abort()
+		if fc.pattern != "" {
+			return errors.Errorf("no matches found: %s", src)
+		}
+		return errors.Wrapf(&os.PathError{Op: "lstat", Path: src, Err: syscall.ENOENT}, "failed to copy")
+	}
+
+	if err := c.wait(true); err != nil {
+		c.abort()
+		return err
+	}
+	if err := c.commit(); err != nil {
+		return err
+	}
+	if c.progressCb != nil {
+		c.progressCb(c.progress, true)
+	}
+	return nil
+}
+
+type fsCopier struct {
+	*copier
+	fs              fsutil.FS
+	dst             string
+	copyDirContents bool
+
+	// base is the slash separated source path without wildcards and
+	// pattern the remaining part with wildcards
+	base    string
+	pattern string
+	matched bool
+
+	// root is the source that is currently copied to rootTarget
+	root       string
+	rootTarget string
+	copying    bool
+
+	// dirs are the open directories that get their metadata when the walk
+	// leaves them
+	dirs []fsDir
+	// links maps the hardlink sources in the FS to the copied files
+	links map[string]string
+}
+
+type fsDir struct {
+	path         string
+	target       string
+	fi           os.FileInfo
+	kind         fsutil.ChangeKind
+	copyFileInfo bool
+}
+
+func (fc *fsCopier) setSource(src string, allowWildcards bool) {
+	src = filepath.ToSlash(filepath.Join("/", src))
+	if allowWildcards {
+		d1, d2 := splitWildcards(filepath.FromSlash(src))
+		src, fc.pattern = filepath.ToSlash(d1), filepath.ToSlash(d2)
+	}
+	fc.base = strings.TrimPrefix(src, "/")
+}
+
+func (fc *fsCopier) run(ctx context.Context) error {
+	if fc.base == "" && fc.pattern == "" {
+		// the root of the FS has no entry of its own
+		fi := &fsutil.StatInfo{Stat: &types.Stat{Mode: uint32(os.ModeDir | 0755)}}
+		target, err := fc.prepareTarget(fi, "/", fc.dst, fc.copyDirContents)
+		if err != nil {
+			return err
+		}
+		if err := MkdirAll(target, 0755, fc.chown, fc.utime); err != nil {
+			return err
+		}
+		fc.matched = true
+		fc.copying = true
+		fc.rootTarget = target
+	}
+
+	if err := fc.fs.Walk(ctx, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		sp := filepath.ToSlash(p)
+		if err := fc.closeDirs(sp); err != nil {
+			return err
+		}
+
+		if fc.copying && isUnder(sp, fc.root) {
+			target := fc.rootTarget
+			if sp != fc.root {
+				target = filepath.Join(target, filepath.FromSlash(strings.TrimPrefix(sp, prefix(fc.root))))
+			}
+			return fc.copyEntry(ctx, p, fi, target, sp != fc.root)
+		}
+		fc.copying = false
+
+		if !fc.selected(sp) {
+			if fi.IsDir() && !fc.mayContain(sp) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target, err := fc.prepareTarget(fi, p, fc.dst, fc.copyDirContents)
+		if err != nil {
+			return err
+		}
+		fc.matched = true
+		fc.copying = true
+		fc.root = sp
+		fc.rootTarget = target
+		return fc.copyEntry(ctx, p, fi, target, false)
+	}); err != nil {
+		return err
+	}
+	return fc.closeDirs("")
+}
+
+// selected returns true if p is one of the sources to copy
+func (fc *fsCopier) selected(p string) bool {
+	if fc.pattern == "" {
+		return p == fc.base
+	}
+	if !isUnder(p, fc.base) || p == fc.base {
+		return false
+	}
+	ok, _ := path.Match(fc.pattern, strings.TrimPrefix(p, prefix(fc.base)))
+	return ok
+}
+
+// mayContain returns true if the directory p can contain a source
+func (fc *fsCopier) mayContain(p string) bool {
+	if isUnder(fc.base, p) {
+		return true
+	}
+	if fc.pattern == "" || !isUnder(p, fc.base) {
+		return false
+	}
+	rel := strings.TrimPrefix(p, prefix(fc.base))
+	return strings.Count(rel, "/") < strings.Count(fc.pattern, "/")
+}
+
+// closeDirs applies the metadata of the open directories that p is not part
+// of. An empty p closes all directories.
+func (fc *fsCopier) closeDirs(p string) error {
+	for len(fc.dirs) > 0 {
+		d := fc.dirs[len(fc.dirs)-1]
+		if p != "" && p != d.path && isUnder(p, d.path) {
+			return nil
+		}
+		fc.dirs = fc.dirs[:len(fc.dirs)-1]
+		if !d.copyFileInfo {
+			continue
+		}
+		fn := func() error {
+			if err := fc.copyMetadata(d.fi, filepath.FromSlash(d.path), d.target); err != nil {
+				return err
+			}
+			return fc.notify(d.kind, d.target, d.fi)
+		}
+		if fc.eg != nil {
+			fc.deferred = append(fc.deferred, fn)
+			continue
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fc *fsCopier) copyEntry(ctx context.Context, src string, fi os.FileInfo, target string, overwriteTargetMetadata bool) error {
+	st, ok := fi.Sys().(*types.Stat)
+	if !ok {
+		return errors.Errorf("unsupported stat type for %s", src)
+	}
+
+	if (fi.Mode() & os.ModeSocket) == os.ModeSocket {
+		switch fc.socketPolicy {
+		case SocketSkip:
+			return fc.skip(target, fi)
+		case SocketError:
+			return errors.Errorf("cannot copy socket %s", src)
+		}
+	}
+
+	kind := fsutil.ChangeKindAdd
+	if !fi.IsDir() {
+		exists, skip, err := fc.ensureEmptyFileTarget(fi, src, target)
+		if err != nil {
+			return err
+		}
+		if exists {
+			kind = fsutil.ChangeKindModify
+		}
+		if skip {
+			return fc.skip(target, fi)
+		}
+	}
+
+	switch {
+	case fi.IsDir():
+		created := false
+		if st, err := os.Lstat(target); err != nil {
+			if !os.IsNotExist(err) {
+				return err
+			}
+			created = true
+			if err := os.Mkdir(target, fi.Mode()); err != nil {
+				return errors.Wrapf(err, "failed to mkdir %s", target)
+			}
+		} else if !st.IsDir() {
+			return errors.Errorf("cannot copy to non-directory: %s", target)
+		} else if overwriteTargetMetadata {
+			if err := os.Chmod(target, fi.Mode()); err != nil {
+				return errors.Wrapf(err, "failed to chmod on %s", target)
+			}
+		}
+		if !created {
+			kind = fsutil.ChangeKindModify
+		}
+		fc.dirs = append(fc.dirs, fsDir{
+			path:         filepath.ToSlash(src),
+			target:       target,
+			fi:           fi,
+			kind:         kind,
+			copyFileInfo: created || overwriteTargetMetadata,
+		})
+		return nil
+	case (fi.Mode() & os.ModeType) == 0:
+		var link string
+		if st.Linkname != "" {
+			link = fc.links[st.Linkname]
+		}
+		if link == "" {
+			key := st.Linkname
+			if key == "" {
+				key = st.Path
+			}
+			fc.links[key] = target
+		}
+		if link != "" {
+			fn := func() error {
+				if err := os.Link(link, target); err != nil {
+					return errors.Wrap(err, "failed to create hard link")
+				}
+				if err := fc.copyMetadata(fi, src, target); err != nil {
+					return err
+				}
+				return fc.notify(kind, target, fi)
+			}
+			if fc.eg != nil {
+				fc.deferred = append(fc.deferred, fn)
+				return nil
+			}
+			return fn()
+		}
+		fn := func() error {
+			if err := fc.copyFileData(src, target, st.Flags); err != nil {
+				return err
+			}
+			if err := fc.copyMetadata(fi, src, target); err != nil {
+				return err
+			}
+			fc.addProgress(fi.Size())
+			return fc.notify(kind, target, fi)
+		}
+		if fc.eg != nil {
+			return fc.goCopy(ctx, fn)
+		}
+		return fn()
+	case (fi.Mode() & os.ModeSymlink) == os.ModeSymlink:
+		if err := os.Symlink(st.Linkname, target); err != nil {
+			return errors.Wrapf(err, "failed to create symlink: %s", target)
+		}
+	case (fi.Mode() & os.ModeDevice) == os.ModeDevice:
+		if err := copyDeviceStat(target, fi, st); err != nil {
+			return errors.Wrapf(err, "failed to create device")
+		}
+	case (fi.Mode() & os.ModeNamedPipe) == os.ModeNamedPipe:
+		if err := copyFifo(target, fi); err != nil {
+			return errors.Wrapf(err, "failed to create fifo")
+		}
+	case (fi.Mode() & os.ModeSocket) == os.ModeSocket:
+		if err := copySocket(target, fi); err != nil {
+			return errors.Wrapf(err, "failed to create socket")
+		}
+	default:
+		return errors.Errorf("unsupported mode %s", fi.Mode())
+	}
+
+	if err := fc.copyMetadata(fi, src, target); err != nil {
+		return err
+	}
+	return fc.notify(kind, target, fi)
+}
+
+func (fc *fsCopier) copyFileData(src, target string, flags uint32) error {
+	rc, err := fc.fs.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open source %s", src)
+	}
+	defer rc.Close()
+	if fc.inodeFlags != fsutil.InodeFlagsSkip {
+		if err := fc.prepareFile(target, flags); err != nil {
+			return err
+		}
+	}
+	tgt, err := os.Create(target)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open target %s", target)
+	}
+	defer tgt.Close()
+
+	var s CopyStrategy
+	if f, ok := rc.(*os.File); ok {
+		s, err = copyFileContent(tgt, f)
+	} else {
+		buf := bufferPool.Get().(*[]byte)
+		_, err = io.CopyBuffer(tgt, rc, *buf)
+		bufferPool.Put(buf)
+		s = StrategyUserspace
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to copy files")
+	}
+	if fc.copyStrategyHandler != nil {
+		fc.copyStrategyHandler(target, src, s)
+	}
+	return nil
+}
+
+// isUnder returns true if the slash separated p is root or inside it. An
+// empty root contains everything.
+func isUnder(p, root string) bool {
+	return root == "" || p == root || strings.HasPrefix(p, root+"/")
+}
+
+func prefix(root string) string {
+	if root == "" {
+		return ""
+	}
+	return root + "/"
+}
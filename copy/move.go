@@ -0,0 +1,184 @@
+package fs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil"
+)
+
+// Move moves files using `mv` semantics. Sources are renamed if possible.
+// If the destination is on another device, already exists or the options
+// change the moved entries, the source is copied with the same semantics as
+// Copy and removed afterwards. Source entries that were skipped or changed
+// during the copy are not removed. Sources that contain sockets are only
+// renamed with SocketPlaceholder, so that the other policies apply to them.
+func Move(ctx context.Context, srcRoot, src, dstRoot, dst string, opts ...Opt) error {
+	var ci CopyInfo
+	for _, o := range opts {
+		o(&ci)
+	}
+	dst, err := ensureDst(dstRoot, dst, ci)
+	if err != nil {
+		return err
+	}
+
+	c := newCopier(ci)
+	c.srcRoot = srcRoot
+	c.dstRoot = dstRoot
+	c.move = true
+	srcs := []string{src}
+
+	if ci.AllowWildcards {
+		matches, err := ResolveWildcards(srcRoot, src, ci.FollowLinks)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return errors.Errorf("no matches found: %s", src)
+		}
+		srcs = matches
+	}
+
+	ctx = c.setParallelism(ctx, ci.Parallelism)
+
+	for _, src := range srcs {
+		srcFollowed, err := rootPath(srcRoot, src, ci.FollowLinks)
+		if err != nil {
+			c.abort()
+			return err
+		}
+		dst, err := c.prepareTargetDir(srcFollowed, src, dst, ci.CopyDirContents)
+		if err != nil {
+			c.abort()
+			return err
+		}
+		renamed, err := c.rename(srcFollowed, dst)
+		if err != nil {
+			c.abort()
+			return err
+		}
+		if renamed {
+			continue
+		}
+		if err := c.setFilter(srcFollowed); err != nil {
+			c.abort()
+			return err
+		}
+		if err := c.copy(ctx, srcFollowed, dst, false); err != nil {
+			c.abort()
+			return err
+		}
+	}
+
+	if err := c.wait(true); err != nil {
+		c.abort()
+		return err
+	}
+	if err := c.commit(); err != nil {
+		c.abort()
+		return err
+	}
+	if err := c.removeMoved(); err != nil {
+		return err
+	}
+	if c.progressCb != nil {
+		c.progressCb(c.progress, true)
+	}
+	return nil
+}
+
+type movedEntry struct {
+	src string
+	fi  os.FileInfo
+}
+
+// rename moves src to a target that does not exist yet. It returns false if
+// src needs to be copied instead.
+func (c *copier) rename(src, target string) (bool, error) {
+	if c.changesEntries() {
+		return false, nil
+	}
+	if c.socketPolicy != SocketPlaceholder {
+		if ok, err := containsSocket(src); err != nil || ok {
+			return false, err
+		}
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return false, nil
+	} else if !os.IsNotExist(err) {
+		return false, errors.Wrap(err, "failed to lstat target")
+	}
+	if err := os.Rename(src, target); err != nil {
+		if errors.Is(err, syscall.EXDEV) {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "failed to rename %s to %s", src, target)
+	}
+	if c.notifyCb == nil {
+		return true, nil
+	}
+	return true, filepath.Walk(target, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return c.notify(fsutil.ChangeKindAdd, p, fi)
+	})
+}
+
+// changesEntries returns true if the copied entries would be different from
+// the source
+func (c *copier) changesEntries() bool {
+	return c.chown != nil || c.utime != nil || c.mode != nil ||
+		c.pathChown != nil || c.pathMode != nil || c.xattrFilter != nil ||
+		len(c.includePatterns) > 0 || len(c.excludePatterns) > 0
+}
+
+var errSocketFound = errors.New("socket found")
+
+// containsSocket returns true if src is or contains a socket
+func containsSocket(src string) (bool, error) {
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			return errSocketFound
+		}
+		return nil
+	})
+	if err == errSocketFound {
+		return true, nil
+	}
+	return false, errors.Wrapf(err, "failed to walk %s", src)
+}
+
+// removeMoved removes the copied source entries after checking that none of
+// them changed during the copy. Directories are kept if they are not empty.
+func (c *copier) removeMoved() error {
+	for _, m := range c.moved {
+		if m.fi.IsDir() {
+			continue
+		}
+		fi, err := os.Lstat(m.src)
+		if err != nil {
+			return errors.Wrapf(err, "failed to verify %s", m.src)
+		}
+		if !os.SameFile(fi, m.fi) || fi.Mode() != m.fi.Mode() || fi.Size() != m.fi.Size() || !fi.ModTime().Equal(m.fi.ModTime()) {
+			return errors.Errorf("source %s changed during move", m.src)
+		}
+	}
+	for i := len(c.moved) - 1; i >= 0; i-- {
+		m := c.moved[i]
+		if err := os.Remove(m.src); err != nil {
+			if m.fi.IsDir() && (errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to remove %s", m.src)
+		}
+	}
+	return nil
+}
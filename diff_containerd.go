@@ -41,8 +41,9 @@ type currentPath struct {
 	//	fullPath string
 }
 
-// doubleWalkDiff walks both directories to create a diff
-func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, filter FilterFunc) (err error) {
+// doubleWalkDiff walks both directories to create a diff. The change time
+// and inode number are only compared if compareExtended is set, see sameFile.
+func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, filter FilterFunc, compareExtended bool) (err error) {
 	g, ctx := errgroup.WithContext(ctx)
 
 	var (
@@ -116,7 +117,7 @@ func doubleWalkDiff(ctx context.Context, changeFn ChangeFunc, a, b walkerFn, fil
 				}
 				f1 = nil
 			case ChangeKindModify:
-				same, err := sameFile(f1, f2copy)
+				same, err := sameFile(f1, f2copy, compareExtended)
 				if err != nil {
 					return err
 				}
@@ -165,7 +166,10 @@ func pathChange(lower, upper *currentPath) (ChangeKind, string) {
 	}
 }
 
-func sameFile(f1, f2 *currentPath) (same bool, retErr error) {
+// sameFile compares the change time and inode number only if compareExtended
+// is set. They differ for any two distinct trees, so this is only useful for
+// two walks of the same tree with WalkOpt.ExtendedStat.
+func sameFile(f1, f2 *currentPath, compareExtended bool) (same bool, retErr error) {
 	// If not a directory also check size, modtime, and content
 	if !f1.stat.IsDir() {
 		if f1.stat.Size_ != f2.stat.Size_ {
@@ -175,6 +179,17 @@ func sameFile(f1, f2 *currentPath) (same bool, retErr error) {
 		if f1.stat.ModTime != f2.stat.ModTime {
 			return false, nil
 		}
+
+		// The change time and inode number are only set if both sides
+		// were walked with WalkOpt.ExtendedStat
+		if compareExtended {
+			if f1.stat.ChangeTime != 0 && f2.stat.ChangeTime != 0 && f1.stat.ChangeTime != f2.stat.ChangeTime {
+				return false, nil
+			}
+			if f1.stat.Ino != 0 && f2.stat.Ino != 0 && f1.stat.Ino != f2.stat.Ino {
+				return false, nil
+			}
+		}
 	}
 
 	return compareStat(f1.stat, f2.stat)
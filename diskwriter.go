@@ -4,15 +4,15 @@ import (
 	"context"
 	"hash"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
 	"sync"
 	"syscall"
-	"time"
 
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/internal/tmpname"
 	"github.com/tonistiigi/fsutil/types"
 	"golang.org/x/sync/errgroup"
 )
@@ -25,10 +25,49 @@ type DiskWriterOpt struct {
 	NotifyCb      func(ChangeKind, string, os.FileInfo, error) error
 	ContentHasher ContentHasher
 	Filter        FilterFunc
+	// MaxOpenFiles limits the number of files that are written
+	// concurrently by AsyncDataCb
+	MaxOpenFiles int
+	// XattrFilter selects the extended attributes that are written
+	XattrFilter *XattrFilter
+	// XattrErrorHandler is called if an extended attribute can't be set.
+	// If it is not set, failing to set security.capability is an error and
+	// the other errors are ignored.
+	XattrErrorHandler XattrErrorHandler
+	// RestoreAccessTime sets the access time from the stat if the sender
+	// provided it with WalkOpt.ExtendedStat. Otherwise the access time is set to the modification
+	// time.
+	RestoreAccessTime bool
+	// NameLookup maps the owner of the files by the user and group names
+	// instead of the numeric ids if the names are known to it
+	NameLookup NameLookup
+	// InodeFlags controls how the inode flags are restored. Immutable and
+	// append-only flags are set by Wait after all files have been written.
+	InodeFlags InodeFlagsPolicy
+	// ContentStore provides the content of regular files that have a
+	// digest in their stat so that it does not need to be requested. The
+	// sender does not need to have the content, see ContentStore.
+	ContentStore ContentStore
+	// ReuseExisting takes the content of files with a digest from the files
+	// that exist under the destination when the writer is created. Removed
+	// files are deleted by Wait so that their content can still be used.
+	// The destination must only hold files the sender may read.
+	ReuseExisting bool
 }
 
+// XattrErrorHandler handles an error setting the extended attribute key on
+// p. Returning nil ignores the error.
+type XattrErrorHandler func(p, key string, err error) error
+
 type FilterFunc func(string, *types.Stat) bool
 
+func accessTime(stat *types.Stat, opt *DiskWriterOpt) int64 {
+	if opt.RestoreAccessTime && stat.AccessTime != 0 {
+		return stat.AccessTime
+	}
+	return stat.ModTime
+}
+
 type DiskWriter struct {
 	opt  DiskWriterOpt
 	dest string
@@ -37,6 +76,24 @@ type DiskWriter struct {
 	cancel func()
 	eg     *errgroup.Group
 	filter FilterFunc
+	files  *fileQueue
+
+	mu sync.Mutex
+	// created and pending track the output of the writer so that it
+	// can be removed if receiving fails
+	created []string
+	pending map[string]struct{}
+	// locked are the files that get immutable or append-only flags
+	locked []lockedFile
+	// index holds the existing files with ReuseExisting and removed the
+	// paths that are deleted by Wait
+	index   *treeIndex
+	removed []string
+}
+
+type lockedFile struct {
+	path  string
+	flags uint32
 }
 
 func NewDiskWriter(ctx context.Context, dest string, opt DiskWriterOpt) (*DiskWriter, error) {
@@ -50,18 +107,72 @@ func NewDiskWriter(ctx context.Context, dest string, opt DiskWriterOpt) (*DiskWr
 	ctx, cancel := context.WithCancel(ctx)
 	eg, ctx := errgroup.WithContext(ctx)
 
+	var index *treeIndex
+	if opt.ReuseExisting {
+		var err error
+		if index, err = newTreeIndex(dest); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+
 	return &DiskWriter{
-		opt:    opt,
-		dest:   dest,
-		eg:     eg,
-		ctx:    ctx,
-		cancel: cancel,
-		filter: opt.Filter,
+		opt:     opt,
+		dest:    dest,
+		eg:      eg,
+		ctx:     ctx,
+		cancel:  cancel,
+		filter:  opt.Filter,
+		files:   newFileQueue(ctx, eg, opt.MaxOpenFiles),
+		pending: map[string]struct{}{},
+		index:   index,
 	}, nil
 }
 
 func (dw *DiskWriter) Wait(ctx context.Context) error {
-	return dw.eg.Wait()
+	if err := dw.eg.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := dw.removeDeferred(); err != nil {
+		return err
+	}
+	return dw.lockFiles(ctx)
+}
+
+// removeDeferred deletes the paths that were removed while their content
+// could still be reused
+func (dw *DiskWriter) removeDeferred() error {
+	dw.mu.Lock()
+	removed := dw.removed
+	dw.removed = nil
+	dw.mu.Unlock()
+	for i := len(removed) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(removed[i]); err != nil {
+			return errors.Wrapf(err, "failed to remove: %s", removed[i])
+		}
+	}
+	return nil
+}
+
+// lockFiles sets the immutable and append-only flags once nothing is written
+// anymore
+func (dw *DiskWriter) lockFiles(ctx context.Context) error {
+	dw.mu.Lock()
+	locked := dw.locked
+	dw.locked = nil
+	dw.mu.Unlock()
+	for _, l := range locked {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := SetInodeFlags(l.path, l.flags, InodeFlagsLocked, dw.opt.InodeFlags); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) (retErr error) {
@@ -91,7 +202,11 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 			}
 		}
 		// todo: no need to validate if diff is trusted but is it always?
-		if err := os.RemoveAll(destPath); err != nil {
+		if dw.index != nil {
+			dw.mu.Lock()
+			dw.removed = append(dw.removed, destPath)
+			dw.mu.Unlock()
+		} else if err := os.RemoveAll(destPath); err != nil {
 			return errors.Wrapf(err, "failed to remove: %s", destPath)
 		}
 		if dw.opt.NotifyCb != nil {
@@ -109,11 +224,22 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 
 	statCopy := *stat
 
+	if dw.opt.NameLookup != nil {
+		mapNames(&statCopy, dw.opt.NameLookup)
+	}
+
 	if dw.filter != nil {
 		if ok := dw.filter(p, &statCopy); !ok {
 			return nil
 		}
 	}
+	statCopy.Xattrs = dw.opt.XattrFilter.Filter(statCopy.Xattrs)
+
+	if dw.opt.InodeFlags != InodeFlagsSkip && statCopy.Flags&InodeFlagsLocked != 0 && (fi.Mode().IsRegular() || fi.IsDir()) {
+		dw.mu.Lock()
+		dw.locked = append(dw.locked, lockedFile{path: destPath, flags: statCopy.Flags})
+		dw.mu.Unlock()
+	}
 
 	rename := true
 	oldFi, err := os.Lstat(destPath)
@@ -129,7 +255,7 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 	}
 
 	if oldFi != nil && fi.IsDir() && oldFi.IsDir() {
-		if err := rewriteMetadata(destPath, &statCopy); err != nil {
+		if err := rewriteMetadata(destPath, &statCopy, &dw.opt); err != nil {
 			return errors.Wrapf(err, "error setting dir metadata for %s", destPath)
 		}
 		return nil
@@ -137,7 +263,12 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 
 	newPath := destPath
 	if rename {
-		newPath = filepath.Join(filepath.Dir(destPath), ".tmp."+nextSuffix())
+		newPath = filepath.Join(filepath.Dir(destPath), ".tmp."+tmpname.Suffix())
+		defer func() {
+			if retErr != nil {
+				os.RemoveAll(newPath)
+			}
+		}()
 	}
 
 	isRegularFile := false
@@ -165,7 +296,29 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		if err != nil {
 			return errors.Wrapf(err, "failed to create %s", newPath)
 		}
+		if err := SetInodeFlags(newPath, statCopy.Flags, InodeFlagsData, dw.opt.InodeFlags); err != nil {
+			file.Close()
+			return err
+		}
 		if dw.opt.SyncDataCb != nil {
+			src, err := dw.localContent(&statCopy)
+			if err != nil {
+				file.Close()
+				return err
+			}
+			if src != "" {
+				file.Close()
+				ok, err := dw.writeLocal(p, fi, &statCopy, src, newPath)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					if err := dw.processChange(ChangeKindAdd, p, fi, &lazyFileWriter{dest: newPath}); err != nil {
+						return err
+					}
+				}
+				break
+			}
 			if err := dw.processChange(ChangeKindAdd, p, fi, file); err != nil {
 				file.Close()
 				return err
@@ -177,8 +330,12 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		}
 	}
 
-	if err := rewriteMetadata(newPath, &statCopy); err != nil {
-		return errors.Wrapf(err, "error setting metadata for %s", newPath)
+	// writing the data clears security.capability, so the metadata of
+	// asynchronously written files is set when their data is complete
+	if !isRegularFile || dw.opt.AsyncDataCb == nil {
+		if err := rewriteMetadata(newPath, &statCopy, &dw.opt); err != nil {
+			return errors.Wrapf(err, "error setting metadata for %s", newPath)
+		}
 	}
 
 	if rename {
@@ -190,6 +347,10 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 		if err := os.Rename(newPath, destPath); err != nil {
 			return errors.Wrapf(err, "failed to rename %s to %s", newPath, destPath)
 		}
+	} else {
+		dw.mu.Lock()
+		dw.created = append(dw.created, destPath)
+		dw.mu.Unlock()
 	}
 
 	if isRegularFile {
@@ -204,33 +365,207 @@ func (dw *DiskWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, er
 }
 
 func (dw *DiskWriter) requestAsyncFileData(p, dest string, fi os.FileInfo, st *types.Stat) {
-	// todo: limit worker threads
-	dw.eg.Go(func() error {
-		if err := dw.processChange(ChangeKindAdd, p, fi, &lazyFileWriter{
-			dest: dest,
-		}); err != nil {
+	dw.mu.Lock()
+	dw.pending[dest] = struct{}{}
+	dw.mu.Unlock()
+	dw.files.Go(func() error {
+		src, err := dw.localContent(st)
+		if err != nil {
 			return err
 		}
-		return chtimes(dest, st.ModTime) // TODO: parent dirs
+		ok := false
+		if src != "" {
+			if ok, err = dw.writeLocal(p, fi, st, src, dest); err != nil {
+				return err
+			}
+		}
+		if !ok {
+			err = dw.processChange(ChangeKindAdd, p, fi, &lazyFileWriter{
+				dest: dest,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if err := rewriteMetadata(dest, st, &dw.opt); err != nil { // TODO: parent dirs
+			return errors.Wrapf(err, "error setting metadata for %s", dest)
+		}
+		dw.mu.Lock()
+		delete(dw.pending, dest)
+		dw.mu.Unlock()
+		return nil
 	})
 }
 
+// fileQueue runs the data requests for at most max files at a time. The
+// requests over the limit are queued instead of blocking HandleChange, so that
+// the caller can keep reading the data of the files in progress.
+type fileQueue struct {
+	ctx     context.Context
+	eg      *errgroup.Group
+	max     int
+	mu      sync.Mutex
+	queue   []func() error
+	running int
+}
+
+func newFileQueue(ctx context.Context, eg *errgroup.Group, max int) *fileQueue {
+	return &fileQueue{ctx: ctx, eg: eg, max: max}
+}
+
+// Go runs fn in eg. A new goroutine is only started if less than max are
+// running.
+func (q *fileQueue) Go(fn func() error) {
+	if q.max <= 0 {
+		q.eg.Go(fn)
+		return
+	}
+	q.mu.Lock()
+	q.queue = append(q.queue, fn)
+	if q.running >= q.max {
+		q.mu.Unlock()
+		return
+	}
+	q.running++
+	q.mu.Unlock()
+	q.eg.Go(q.work)
+}
+
+func (q *fileQueue) work() error {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.running--
+			q.mu.Unlock()
+			return nil
+		}
+		fn := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+		if err := q.ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+}
+
+// Dir returns the destination directory of the writer
+func (dw *DiskWriter) Dir() string {
+	return dw.dest
+}
+
+// RemovePartial removes the files that were created by the writer and the
+// files that did not receive all of their data. Existing files that were
+// replaced or changed are not restored. It must only be called after Wait
+// has returned.
+func (dw *DiskWriter) RemovePartial() error {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	var rerr error
+	for p := range dw.pending {
+		if err := os.RemoveAll(p); err != nil && rerr == nil {
+			rerr = errors.Wrapf(err, "failed to remove %s", p)
+		}
+	}
+	for i := len(dw.created) - 1; i >= 0; i-- {
+		if err := os.RemoveAll(dw.created[i]); err != nil && rerr == nil {
+			rerr = errors.Wrapf(err, "failed to remove %s", dw.created[i])
+		}
+	}
+	dw.pending = map[string]struct{}{}
+	dw.created = nil
+	return rerr
+}
+
+// localContent returns the path of a local file with the content of the
+// regular file st or an empty string if the content needs to be requested
+func (dw *DiskWriter) localContent(st *types.Stat) (string, error) {
+	if st.Digest == "" || st.Size_ == 0 || (dw.opt.ContentStore == nil && dw.index == nil) {
+		return "", nil
+	}
+	dgst, err := digest.Parse(st.Digest)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid digest for %s", st.Path)
+	}
+	if dw.opt.ContentStore != nil {
+		p, err := dw.opt.ContentStore.Path(dw.ctx, dgst)
+		if err != nil || p != "" {
+			return p, err
+		}
+	}
+	if dw.index != nil {
+		return dw.index.lookup(dgst, st.Size_)
+	}
+	return "", nil
+}
+
+// writeLocal writes the content of the local file src to dest instead of
+// requesting it. It returns false if the content of src does not match the
+// digest of st and needs to be requested.
+func (dw *DiskWriter) writeLocal(p string, fi os.FileInfo, st *types.Stat, src, dest string) (bool, error) {
+	ok, err := copyLocalFile(src, dest, digest.Digest(st.Digest))
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, notifyLocal(&dw.opt, ChangeKindAdd, p, fi, dest)
+}
+
+// notifyLocal calls NotifyCb for a file whose content was taken from the
+// local file src instead of being received
+func notifyLocal(opt *DiskWriterOpt, kind ChangeKind, p string, fi os.FileInfo, src string) error {
+	if opt.NotifyCb == nil {
+		return nil
+	}
+	hw, err := newHashWriter(opt.ContentHasher, fi, nopWriteCloser{ioutil.Discard})
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = io.Copy(hw, f)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "failed to hash %s", src)
+	}
+	hw.Close()
+	return opt.NotifyCb(kind, p, hw, nil)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
 func (dw *DiskWriter) processChange(kind ChangeKind, p string, fi os.FileInfo, w io.WriteCloser) error {
+	return processChange(dw.ctx, &dw.opt, kind, p, fi, w)
+}
+
+// processChange fills w with the data callback of opt and reports the change
+// to the NotifyCb of opt
+func processChange(ctx context.Context, opt *DiskWriterOpt, kind ChangeKind, p string, fi os.FileInfo, w io.WriteCloser) error {
 	origw := w
 	var hw *hashedWriter
-	if dw.opt.NotifyCb != nil {
+	if opt.NotifyCb != nil {
 		var err error
-		if hw, err = newHashWriter(dw.opt.ContentHasher, fi, w); err != nil {
+		if hw, err = newHashWriter(opt.ContentHasher, fi, w); err != nil {
 			return err
 		}
 		w = hw
 	}
 	if origw != nil {
-		fn := dw.opt.SyncDataCb
-		if fn == nil && dw.opt.AsyncDataCb != nil {
-			fn = dw.opt.AsyncDataCb
+		fn := opt.SyncDataCb
+		if fn == nil && opt.AsyncDataCb != nil {
+			fn = opt.AsyncDataCb
 		}
-		if err := fn(dw.ctx, p, w); err != nil {
+		if err := fn(ctx, p, w); err != nil {
 			return err
 		}
 	} else {
@@ -239,7 +574,7 @@ func (dw *DiskWriter) processChange(kind ChangeKind, p string, fi os.FileInfo, w
 		}
 	}
 	if hw != nil {
-		return dw.opt.NotifyCb(kind, p, hw, nil)
+		return opt.NotifyCb(kind, p, hw, nil)
 	}
 	return nil
 }
@@ -271,6 +606,13 @@ func newHashWriter(ch ContentHasher, fi os.FileInfo, w io.WriteCloser) (*hashedW
 	return hw, nil
 }
 
+func (hw *hashedWriter) WriteHole(n int64) error {
+	if err := writeZeros(hw.h, n); err != nil {
+		return err
+	}
+	return writeHole(hw.w, n)
+}
+
 func (hw *hashedWriter) Close() error {
 	hw.dgst = digest.NewDigest(digest.SHA256, hw.h)
 	if hw.w != nil {
@@ -287,9 +629,32 @@ type lazyFileWriter struct {
 	dest     string
 	f        *os.File
 	fileMode *os.FileMode
+	// offset is the end of a trailing hole that still needs to be
+	// allocated with truncate on close
+	offset int64
 }
 
 func (lfw *lazyFileWriter) Write(dt []byte) (int, error) {
+	if err := lfw.open(); err != nil {
+		return 0, err
+	}
+	lfw.offset = 0
+	return lfw.f.Write(dt)
+}
+
+func (lfw *lazyFileWriter) WriteHole(n int64) error {
+	if err := lfw.open(); err != nil {
+		return err
+	}
+	off, err := lfw.f.Seek(n, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "failed to seek %s", lfw.dest)
+	}
+	lfw.offset = off
+	return nil
+}
+
+func (lfw *lazyFileWriter) open() error {
 	if lfw.f == nil {
 		file, err := os.OpenFile(lfw.dest, os.O_WRONLY, 0) //todo: windows
 		if os.IsPermission(err) {
@@ -305,17 +670,22 @@ func (lfw *lazyFileWriter) Write(dt []byte) (int, error) {
 			}
 		}
 		if err != nil {
-			return 0, errors.Wrapf(err, "failed to open %s", lfw.dest)
+			return errors.Wrapf(err, "failed to open %s", lfw.dest)
 		}
 		lfw.f = file
 	}
-	return lfw.f.Write(dt)
+	return nil
 }
 
 func (lfw *lazyFileWriter) Close() error {
 	var err error
 	if lfw.f != nil {
-		err = lfw.f.Close()
+		if lfw.offset > 0 {
+			err = lfw.f.Truncate(lfw.offset)
+		}
+		if err1 := lfw.f.Close(); err == nil {
+			err = err1
+		}
 	}
 	if err == nil && lfw.fileMode != nil {
 		err = os.Chmod(lfw.dest, *lfw.fileMode)
@@ -326,26 +696,3 @@ func (lfw *lazyFileWriter) Close() error {
 func mkdev(major int64, minor int64) uint32 {
 	return uint32(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff))
 }
-
-// Random number state.
-// We generate random temporary file names so that there's a good
-// chance the file doesn't exist yet - keeps the number of tries in
-// TempFile to a minimum.
-var rand uint32
-var randmu sync.Mutex
-
-func reseed() uint32 {
-	return uint32(time.Now().UnixNano() + int64(os.Getpid()))
-}
-
-func nextSuffix() string {
-	randmu.Lock()
-	r := rand
-	if r == 0 {
-		r = reseed()
-	}
-	r = r*1664525 + 1013904223 // constants from Numerical Recipes
-	rand = r
-	randmu.Unlock()
-	return strconv.Itoa(int(1e9 + r%1e9))[1:]
-}
@@ -15,6 +15,8 @@ import (
 	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
 )
 
 // requiresRoot skips tests that require root
@@ -169,6 +171,56 @@ file foo2
 
 }
 
+func TestWalkerWriterContentStore(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file mydata",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dgst := digest.FromString("mydata")
+	store, err := ioutil.TempDir("", "store")
+	assert.NoError(t, err)
+	defer os.RemoveAll(store)
+
+	write := func(content string) []string {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(store, "blob"), []byte(content), 0600))
+
+		dest, err := ioutil.TempDir("", "dest")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		var requested []string
+		writeTo := newWriteToFunc(d, 0)
+		dw, err := NewDiskWriter(context.TODO(), dest, DiskWriterOpt{
+			SyncDataCb: func(ctx context.Context, p string, wc io.WriteCloser) error {
+				requested = append(requested, p)
+				return writeTo(ctx, p, wc)
+			},
+			ContentStore: mapStore{dgst: filepath.Join(store, "blob")},
+		})
+		assert.NoError(t, err)
+
+		err = Walk(context.Background(), d, &WalkOpt{
+			Map: func(_ string, s *types.Stat) bool {
+				s.Digest = dgst.String()
+				return true
+			},
+		}, readAsAdd(dw.HandleChange))
+		assert.NoError(t, err)
+		assert.NoError(t, dw.Wait(context.TODO()))
+
+		dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, "mydata", string(dt))
+		return requested
+	}
+
+	assert.Nil(t, write("mydata"))
+	// the store content changed so it is requested
+	assert.Equal(t, []string{"foo"}, write("a longer content"))
+}
+
 func TestWalkerWriterAsync(t *testing.T) {
 	d, err := tmpDir(changeStream([]string{
 		"ADD foo dir",
@@ -290,3 +342,31 @@ func (nb *notificationBuffer) Hash(p string) (digest.Digest, bool) {
 	nb.Unlock()
 	return v, ok
 }
+
+func TestFileQueue(t *testing.T) {
+	eg, ctx := errgroup.WithContext(context.Background())
+	q := newFileQueue(ctx, eg, 2)
+
+	var mu sync.Mutex
+	running, max, done := 0, 0, 0
+	for i := 0; i < 20; i++ {
+		q.Go(func() error {
+			mu.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			done++
+			mu.Unlock()
+			return nil
+		})
+	}
+	assert.NoError(t, eg.Wait())
+	assert.Equal(t, 20, done)
+	assert.True(t, max <= 2, "max %d", max)
+	assert.Equal(t, 0, q.running)
+}
@@ -11,11 +11,11 @@ import (
 	"github.com/tonistiigi/fsutil/types"
 )
 
-func rewriteMetadata(p string, stat *types.Stat) error {
-	for key, value := range stat.Xattrs {
-		sysx.Setxattr(p, key, value, 0)
-	}
-
+// rewriteMetadata applies the metadata in an order that keeps it intact:
+// chown clears setuid bits and security.capability, so the mode and the
+// xattrs are set after it. POSIX ACLs are set after chmod as it would
+// replace the ACL mask with the group permission bits.
+func rewriteMetadata(p string, stat *types.Stat, opt *DiskWriterOpt) error {
 	if err := os.Lchown(p, int(stat.Uid), int(stat.Gid)); err != nil {
 		return errors.WithStack(err)
 	}
@@ -24,12 +24,39 @@ func rewriteMetadata(p string, stat *types.Stat) error {
 		if err := os.Chmod(p, os.FileMode(stat.Mode)); err != nil {
 			return errors.WithStack(err)
 		}
+
+		if err := removeInheritedACLs(p, stat, opt.XattrFilter); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range stat.Xattrs {
+		if err := sysx.LSetxattr(p, key, value, 0); err != nil {
+			err = errors.Wrapf(err, "failed to set xattr %q on %s", key, p)
+			if opt.XattrErrorHandler == nil {
+				// a binary without its capabilities fails at runtime
+				if key == xattrCapability {
+					return err
+				}
+				continue
+			}
+			if err := opt.XattrErrorHandler(p, key, err); err != nil {
+				return err
+			}
+		}
 	}
 
-	if err := chtimes(p, stat.ModTime); err != nil {
+	if err := chtimes(p, accessTime(stat, opt), stat.ModTime); err != nil {
 		return err
 	}
 
+	// the locked flags are set by DiskWriter.Wait
+	if m := os.FileMode(stat.Mode); m.IsRegular() || m.IsDir() {
+		if err := SetInodeFlags(p, stat.Flags, InodeFlagsMask&^InodeFlagsLocked, opt.InodeFlags); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
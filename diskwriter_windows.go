@@ -7,8 +7,11 @@ import (
 	"github.com/tonistiigi/fsutil/types"
 )
 
-func rewriteMetadata(p string, stat *types.Stat) error {
-	return chtimes(p, stat.ModTime)
+func rewriteMetadata(p string, stat *types.Stat, opt *DiskWriterOpt) error {
+	if err := chtimes(p, accessTime(stat, opt), stat.ModTime); err != nil {
+		return err
+	}
+	return SetInodeFlags(p, stat.Flags, InodeFlagsMask, opt.InodeFlags)
 }
 
 // handleTarTypeBlockCharFifo is an OS-specific helper function used by
@@ -0,0 +1,151 @@
+package fsutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/fileutils"
+)
+
+// FilterDecision is the outcome of filtering a path during Walk
+type FilterDecision int
+
+const (
+	// FilterIncluded means the path was passed to the walk function
+	FilterIncluded FilterDecision = iota
+	// FilterExcluded means the path was left out of the walk
+	FilterExcluded
+	// FilterSkippedDir means the directory and everything inside it were
+	// left out of the walk
+	FilterSkippedDir
+)
+
+func (d FilterDecision) String() string {
+	switch d {
+	case FilterIncluded:
+		return "included"
+	case FilterExcluded:
+		return "excluded"
+	case FilterSkippedDir:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// FilterRule is the kind of rule responsible for a FilterDecision
+type FilterRule int
+
+const (
+	// FilterRuleNone means no rule applied to the path
+	FilterRuleNone FilterRule = iota
+	// FilterRuleInclude means the decision was made by IncludePatterns or
+	// FollowPaths. The pattern is empty if the path was excluded because
+	// none of the patterns matched it.
+	FilterRuleInclude
+	// FilterRuleExclude means the decision was made by ExcludePatterns
+	FilterRuleExclude
+	// FilterRuleIgnoreFile means the decision was made by a rule in one of
+	// the IgnoreFiles
+	FilterRuleIgnoreFile
+	// FilterRuleMap means the path was rejected by the Map function
+	FilterRuleMap
+	// FilterRuleLimit means the path was skipped because it exceeded
+	// one of the Limits
+	FilterRuleLimit
+)
+
+func (r FilterRule) String() string {
+	switch r {
+	case FilterRuleNone:
+		return "none"
+	case FilterRuleInclude:
+		return "include"
+	case FilterRuleExclude:
+		return "exclude"
+	case FilterRuleIgnoreFile:
+		return "ignorefile"
+	case FilterRuleMap:
+		return "map"
+	case FilterRuleLimit:
+		return "limit"
+	}
+	return "unknown"
+}
+
+// FilterTrace describes why a path was or was not included in a walk
+type FilterTrace struct {
+	Path     string
+	Decision FilterDecision
+	Rule     FilterRule
+	// Pattern is the pattern responsible for the decision. Exceptions are
+	// prefixed with "!".
+	Pattern string
+	// IgnoreFile is the ignore file that contains Pattern for
+	// FilterRuleIgnoreFile
+	IgnoreFile string
+}
+
+// TraceFunc is called for every path considered by Walk
+type TraceFunc func(FilterTrace)
+
+func (t *FilterTrace) set(rule FilterRule, pattern, ignoreFile string) {
+	t.Rule = rule
+	t.Pattern = pattern
+	t.IgnoreFile = ignoreFile
+}
+
+// skipPath reports the path as filtered out and returns the value the walk
+// function should return for it
+func skipPath(opt *WalkOpt, t *FilterTrace, fi os.FileInfo) error {
+	t.Decision = FilterExcluded
+	if fi.IsDir() {
+		t.Decision = FilterSkippedDir
+	}
+	if opt.Trace != nil {
+		opt.Trace(*t)
+	}
+	if fi.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// excludeTracer finds the exclude pattern that decided the result of
+// fileutils.PatternMatcher.Matches
+type excludeTracer struct {
+	patterns []*fileutils.Pattern
+	pms      []*fileutils.PatternMatcher
+}
+
+func newExcludeTracer(pm *fileutils.PatternMatcher) (*excludeTracer, error) {
+	et := &excludeTracer{patterns: pm.Patterns()}
+	for _, p := range et.patterns {
+		single, err := fileutils.NewPatternMatcher([]string{p.String()})
+		if err != nil {
+			return nil, err
+		}
+		et.pms = append(et.pms, single)
+	}
+	return et, nil
+}
+
+// match returns the last pattern matching p, as it is the one that wins
+func (et *excludeTracer) match(p string) (string, error) {
+	for i := len(et.pms) - 1; i >= 0; i-- {
+		m, err := et.pms[i].Matches(p)
+		if err != nil {
+			return "", err
+		}
+		if m {
+			return excludePatternString(et.patterns[i]), nil
+		}
+	}
+	return "", nil
+}
+
+func excludePatternString(p *fileutils.Pattern) string {
+	if p.Exclusion() {
+		return "!" + p.String()
+	}
+	return p.String()
+}
@@ -0,0 +1,41 @@
+package fsutil
+
+// Inode flags as returned by the FS_IOC_GETFLAGS ioctl on Linux
+const (
+	InodeFlagCompress    = 0x00000004
+	InodeFlagSync        = 0x00000008
+	InodeFlagImmutable   = 0x00000010
+	InodeFlagAppend      = 0x00000020
+	InodeFlagNoDump      = 0x00000040
+	InodeFlagNoAtime     = 0x00000080
+	InodeFlagNoCompress  = 0x00000400
+	InodeFlagDirSync     = 0x00010000
+	InodeFlagNoCow       = 0x00800000
+	InodeFlagProjInherit = 0x20000000
+)
+
+const (
+	// InodeFlagsMask are the flags that are captured and restored
+	InodeFlagsMask = InodeFlagCompress | InodeFlagSync | InodeFlagImmutable |
+		InodeFlagAppend | InodeFlagNoDump | InodeFlagNoAtime | InodeFlagNoCompress |
+		InodeFlagDirSync | InodeFlagNoCow | InodeFlagProjInherit
+	// InodeFlagsLocked prevent changes to the file so they need to be set
+	// after everything else
+	InodeFlagsLocked = InodeFlagImmutable | InodeFlagAppend
+	// InodeFlagsData change how data is stored so they need to be set before
+	// the data is written
+	InodeFlagsData = InodeFlagCompress | InodeFlagNoCompress | InodeFlagNoCow
+)
+
+// InodeFlagsPolicy controls how inode flags are restored
+type InodeFlagsPolicy int
+
+const (
+	// InodeFlagsSkip does not restore the inode flags
+	InodeFlagsSkip InodeFlagsPolicy = iota
+	// InodeFlagsRequire returns an error if a flag can't be set
+	InodeFlagsRequire
+	// InodeFlagsIgnoreUnsupported leaves out the flags that the filesystem
+	// does not support
+	InodeFlagsIgnoreUnsupported
+)
@@ -0,0 +1,92 @@
+// +build linux
+
+package fsutil
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// GetInodeFlags returns the flags in InodeFlagsMask of a regular file or a
+// directory. It returns zero if the filesystem does not support inode flags
+// or if the file can't be opened for reading.
+func GetInodeFlags(p string) (uint32, error) {
+	f, err := openInode(p)
+	if err != nil {
+		if errors.Is(err, unix.EACCES) || errors.Is(err, unix.EPERM) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if isUnsupportedFlagsErr(err) {
+			return 0, nil
+		}
+		return 0, errors.Wrapf(err, "failed to get inode flags of %s", p)
+	}
+	return flags & InodeFlagsMask, nil
+}
+
+// SetInodeFlags sets the flags in mask on the regular file or directory p
+// to their value in flags. The other flags are kept.
+func SetInodeFlags(p string, flags, mask uint32, policy InodeFlagsPolicy) error {
+	if policy == InodeFlagsSkip {
+		return nil
+	}
+	mask &= InodeFlagsMask
+	f, err := openInode(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+
+	cur, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if isUnsupportedFlagsErr(err) && (flags&mask == 0 || policy == InodeFlagsIgnoreUnsupported) {
+			return nil
+		}
+		return errors.Wrapf(err, "failed to get inode flags of %s", p)
+	}
+	changed := (cur ^ flags) & mask
+	if changed == 0 {
+		return nil
+	}
+	err = unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(int32(cur^changed)))
+	if err == nil {
+		return nil
+	}
+	if !isUnsupportedFlagsErr(err) || policy != InodeFlagsIgnoreUnsupported {
+		return errors.Wrapf(err, "failed to set inode flags of %s", p)
+	}
+	// change the flags one by one to leave out the unsupported ones
+	for bit := uint32(1); bit != 0; bit <<= 1 {
+		if changed&bit == 0 {
+			continue
+		}
+		if err := unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(int32(cur^bit))); err != nil {
+			if isUnsupportedFlagsErr(err) {
+				continue
+			}
+			return errors.Wrapf(err, "failed to set inode flags of %s", p)
+		}
+		cur ^= bit
+	}
+	return nil
+}
+
+func openInode(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+func isUnsupportedFlagsErr(err error) bool {
+	return errors.Is(err, unix.ENOTTY) || errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EINVAL)
+}
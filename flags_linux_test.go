@@ -0,0 +1,115 @@
+package fsutil
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestSendReceiveInodeFlags(t *testing.T) {
+	requiresRoot(t)
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+		"ADD foo file data1",
+		"ADD sub dir",
+		"ADD sub/baz file data3",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	if err := SetInodeFlags(filepath.Join(d, "foo"), InodeFlagNoDump, InodeFlagsMask, InodeFlagsRequire); err != nil {
+		t.Skipf("inode flags not supported: %v", err)
+	}
+	require.NoError(t, SetInodeFlags(filepath.Join(d, "sub"), InodeFlagNoDump|InodeFlagImmutable, InodeFlagsMask, InodeFlagsRequire))
+	defer unlock(filepath.Join(d, "sub"))
+
+	flags, err := GetInodeFlags(filepath.Join(d, "sub"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(InodeFlagNoDump|InodeFlagImmutable), flags)
+
+	receive := func(dest string, policy InodeFlagsPolicy) error {
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, NewFS(d, &WalkOpt{
+				InodeFlags: true,
+				Map: func(p string, s *types.Stat) bool {
+					// no-CoW is not supported by every filesystem
+					if p == "bar" {
+						s.Flags |= InodeFlagNoCow
+					}
+					return true
+				},
+			}), nil)
+		})
+		eg.Go(func() error {
+			return Receive(ctx, s2, dest, ReceiveOpt{InodeFlags: policy})
+		})
+		return eg.Wait()
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	defer unlock(filepath.Join(dest, "sub"))
+
+	require.NoError(t, receive(dest, InodeFlagsIgnoreUnsupported))
+
+	for p, expected := range map[string]uint32{
+		"foo":     InodeFlagNoDump,
+		"sub":     InodeFlagNoDump | InodeFlagImmutable,
+		"sub/baz": 0,
+	} {
+		flags, err := GetInodeFlags(filepath.Join(dest, p))
+		require.NoError(t, err)
+		assert.Equal(t, expected, flags, p)
+	}
+	flags, err = GetInodeFlags(filepath.Join(dest, "bar"))
+	require.NoError(t, err)
+	if flags&InodeFlagNoCow == 0 {
+		// the filesystem does not support no-CoW so it needs to be ignored
+		dest2, err := ioutil.TempDir("", "dest")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest2)
+		defer unlock(filepath.Join(dest2, "sub"))
+
+		require.Error(t, receive(dest2, InodeFlagsRequire))
+	}
+}
+
+func unlock(p string) {
+	SetInodeFlags(p, 0, InodeFlagsLocked, InodeFlagsIgnoreUnsupported)
+}
+
+func TestWalkInodeFlagsUnreadable(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can open every file")
+	}
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	require.NoError(t, os.Chmod(filepath.Join(d, "foo"), 0))
+
+	var paths []string
+	err = Walk(context.Background(), d, &WalkOpt{InodeFlags: true}, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		paths = append(paths, p)
+		assert.Equal(t, uint32(0), fi.Sys().(*types.Stat).Flags)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo"}, paths)
+}
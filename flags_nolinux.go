@@ -0,0 +1,21 @@
+// +build !linux
+
+package fsutil
+
+import (
+	"github.com/pkg/errors"
+)
+
+// GetInodeFlags returns zero as inode flags are only supported on Linux
+func GetInodeFlags(p string) (uint32, error) {
+	return 0, nil
+}
+
+// SetInodeFlags returns an error with InodeFlagsRequire if any of the flags
+// in mask is set as inode flags are only supported on Linux
+func SetInodeFlags(p string, flags, mask uint32, policy InodeFlagsPolicy) error {
+	if policy == InodeFlagsRequire && flags&mask&InodeFlagsMask != 0 {
+		return errors.Errorf("failed to set inode flags of %s: not supported", p)
+	}
+	return nil
+}
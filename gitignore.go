@@ -0,0 +1,271 @@
+package fsutil
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ignoreMatcher applies per-directory ignore files (e.g. .gitignore) with
+// git's semantics. Ignore files are loaded lazily as the walk descends so
+// that rules only apply to the subtree of the directory that contains them.
+type ignoreMatcher struct {
+	root  string
+	names []string
+	// stack holds the scope of every directory from the root to the
+	// directory currently being walked
+	stack []*ignoreScope
+}
+
+type ignoreScope struct {
+	dir   string
+	rules []*ignoreRule
+}
+
+type ignoreRule struct {
+	pattern string
+	source  string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+func newIgnoreMatcher(root string, names []string) *ignoreMatcher {
+	return &ignoreMatcher{root: root, names: names}
+}
+
+// match returns the rule that decides if p is ignored or nil if no rule
+// matches p
+func (m *ignoreMatcher) match(p string, isDir bool) (*ignoreRule, error) {
+	p = filepath.ToSlash(p)
+	scopes, err := m.scopes(path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	// deeper ignore files take precedence and inside a file the last
+	// matching rule wins
+	for i := len(scopes) - 1; i >= 0; i-- {
+		s := scopes[i]
+		rel := p
+		if s.dir != "" {
+			rel = strings.TrimPrefix(p, s.dir+"/")
+		}
+		for j := len(s.rules) - 1; j >= 0; j-- {
+			r := s.rules[j]
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if r.re.MatchString(rel) {
+				return r, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// scopes returns the loaded scopes for dir and all of its parents, loading
+// ignore files for directories that have not been seen yet
+func (m *ignoreMatcher) scopes(dir string) ([]*ignoreScope, error) {
+	var parts []string
+	if dir != "." {
+		parts = strings.Split(dir, "/")
+	}
+	for len(m.stack) > 0 {
+		n := len(m.stack) - 1
+		if n <= len(parts) && m.stack[n].dir == strings.Join(parts[:n], "/") {
+			break
+		}
+		m.stack = m.stack[:n]
+	}
+	for k := len(m.stack); k <= len(parts); k++ {
+		s, err := m.load(strings.Join(parts[:k], "/"))
+		if err != nil {
+			return nil, err
+		}
+		m.stack = append(m.stack, s)
+	}
+	return m.stack, nil
+}
+
+func (m *ignoreMatcher) load(dir string) (*ignoreScope, error) {
+	s := &ignoreScope{dir: dir}
+	for _, name := range m.names {
+		fn := filepath.Join(m.root, filepath.FromSlash(dir), name)
+		dt, err := ioutil.ReadFile(fn)
+		if err != nil {
+			if isNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to read ignore file %s", fn)
+		}
+		rules, err := parseIgnoreFile(dt, path.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s.rules = append(s.rules, rules...)
+	}
+	return s, nil
+}
+
+func parseIgnoreFile(dt []byte, source string) ([]*ignoreRule, error) {
+	var rules []*ignoreRule
+	scanner := bufio.NewScanner(bytes.NewReader(dt))
+	for scanner.Scan() {
+		r, err := parseIgnoreRule(scanner.Text(), source)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			rules = append(rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse ignore file %s", source)
+	}
+	return rules, nil
+}
+
+func parseIgnoreRule(line, source string) (*ignoreRule, error) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimIgnoreTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+	r := &ignoreRule{pattern: line, source: source}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+	// a slash at the beginning or in the middle anchors the pattern to
+	// the directory of the ignore file, otherwise it matches at any depth
+	if strings.HasPrefix(line, "/") {
+		line = line[1:]
+	} else if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	re, err := regexp.Compile(ignorePatternToRegexp(line))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ignore pattern %q in %s", r.pattern, source)
+	}
+	r.re = re
+	return r, nil
+}
+
+// trimIgnoreTrailingSpaces removes trailing spaces unless they are escaped
+// with a backslash
+func trimIgnoreTrailingSpaces(s string) string {
+	for strings.HasSuffix(s, " ") {
+		if strings.HasSuffix(s, "\\ ") {
+			return s
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+func ignorePatternToRegexp(p string) string {
+	var sb strings.Builder
+	sb.WriteString("^")
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		last := i == len(segs)-1
+		if seg == "**" {
+			switch {
+			case last && i == 0:
+				sb.WriteString(".*")
+			case last:
+				// trailing "/**" matches everything inside
+				sb.WriteString(".+")
+			default:
+				// leading "**/" and "/**/" match zero or more directories
+				sb.WriteString("(?:.*/)?")
+			}
+			continue
+		}
+		sb.WriteString(ignoreSegmentToRegexp(seg))
+		if !last {
+			sb.WriteString("/")
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+func ignoreSegmentToRegexp(seg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(seg); i++ {
+		ch := seg[i]
+		switch ch {
+		case '*':
+			sb.WriteString("[^/]*")
+			// other consecutive asterisks are regular asterisks
+			for i+1 < len(seg) && seg[i+1] == '*' {
+				i++
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '\\':
+			if i+1 < len(seg) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(seg[i])))
+			} else {
+				sb.WriteString(regexp.QuoteMeta("\\"))
+			}
+		case '[':
+			if class, n := ignoreClassToRegexp(seg[i:]); n > 0 {
+				sb.WriteString(class)
+				i += n - 1
+				continue
+			}
+			sb.WriteString(regexp.QuoteMeta("["))
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	return sb.String()
+}
+
+// ignoreClassToRegexp converts a bracket expression at the start of s and
+// returns the number of bytes consumed, or 0 if the expression is unclosed
+func ignoreClassToRegexp(s string) (string, int) {
+	var sb strings.Builder
+	sb.WriteString("[")
+	i := 1
+	if i < len(s) && (s[i] == '!' || s[i] == '^') {
+		sb.WriteString("^")
+		i++
+	}
+	first := true
+	for ; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == ']' && !first:
+			sb.WriteString("]")
+			return sb.String(), i + 1
+		case ch == '\\' && i+1 < len(s):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(s[i])))
+		case ch == '-':
+			sb.WriteString("-")
+		case ch == '/':
+			return "", 0
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+		first = false
+	}
+	return "", 0
+}
@@ -0,0 +1,2 @@
+// Package clone shares the data of files on filesystems that support it
+package clone
@@ -0,0 +1,9 @@
+// +build linux,!mips,!mipsle,!mips64,!mips64le,!ppc,!ppc64,!ppc64le,!sparc64
+
+package clone
+
+// ioctl direction bits
+const (
+	iocWrite    = 1
+	iocDirShift = 30
+)
@@ -0,0 +1,9 @@
+// +build linux,mips linux,mipsle linux,mips64 linux,mips64le linux,ppc linux,ppc64 linux,ppc64le linux,sparc64
+
+package clone
+
+// ioctl direction bits, which use three bits on these architectures
+const (
+	iocWrite    = 4
+	iocDirShift = 29
+)
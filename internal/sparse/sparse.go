@@ -0,0 +1,8 @@
+// Package sparse finds the data regions of files with holes
+package sparse
+
+// Extent is a region of a file that contains data
+type Extent struct {
+	Offset int64
+	Length int64
+}
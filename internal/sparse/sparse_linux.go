@@ -0,0 +1,64 @@
+// +build linux
+
+package sparse
+
+import (
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lseek whence values for finding holes, missing from golang.org/x/sys/unix
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// IsSparse returns true if fi uses less blocks than its size requires
+func IsSparse(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < fi.Size()
+}
+
+// DataExtents returns the data regions of f or nil if the file has no holes
+// or holes can't be detected
+func DataExtents(f *os.File, fi os.FileInfo) ([]Extent, error) {
+	if !IsSparse(fi) {
+		return nil, nil
+	}
+	size := fi.Size()
+	fd := int(f.Fd())
+	var out []Extent
+	for off := int64(0); off < size; {
+		data, err := unix.Seek(fd, off, seekData)
+		if err != nil {
+			if err == unix.ENXIO {
+				// only a hole is left
+				break
+			}
+			if off == 0 && (err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+				return nil, nil
+			}
+			return nil, errors.Wrapf(err, "failed to seek data in %s", f.Name())
+		}
+		hole, err := unix.Seek(fd, data, seekHole)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to seek hole in %s", f.Name())
+		}
+		if hole > size {
+			hole = size
+		}
+		out = append(out, Extent{Offset: data, Length: hole - data})
+		off = hole
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(out) == 1 && out[0].Offset == 0 && out[0].Length == size {
+		return nil, nil
+	}
+	return out, nil
+}
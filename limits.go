@@ -0,0 +1,150 @@
+package fsutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// LimitKind identifies one of the Limits
+type LimitKind int
+
+const (
+	LimitMaxEntries LimitKind = iota
+	LimitMaxTotalSize
+	LimitMaxDepth
+	LimitMaxFileSize
+	LimitMaxPathLength
+	LimitMaxXattrSize
+)
+
+func (k LimitKind) String() string {
+	switch k {
+	case LimitMaxEntries:
+		return "max entries"
+	case LimitMaxTotalSize:
+		return "max total size"
+	case LimitMaxDepth:
+		return "max depth"
+	case LimitMaxFileSize:
+		return "max file size"
+	case LimitMaxPathLength:
+		return "max path length"
+	case LimitMaxXattrSize:
+		return "max xattr size"
+	}
+	return "unknown"
+}
+
+// Limits restricts the amount of data that can be walked or received. Zero
+// values mean that there is no limit.
+type Limits struct {
+	MaxEntries   int64
+	MaxTotalSize int64
+	MaxDepth     int
+	MaxFileSize  int64
+	// MaxPathLength applies to both the path and the link target
+	MaxPathLength int
+	// MaxXattrSize is the maximum total size of the extended attribute
+	// keys and values of a single entry
+	MaxXattrSize int64
+	// Handler is called when an entry exceeds a limit. If it returns nil
+	// the entry is skipped, otherwise the error is returned. If Handler is
+	// not set exceeding a limit returns the *LimitError.
+	Handler LimitErrorHandler
+}
+
+type LimitErrorHandler func(*LimitError) error
+
+// LimitError is returned when a path exceeds one of the Limits
+type LimitError struct {
+	Path  string
+	Kind  LimitKind
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds %s limit of %d", e.Path, e.Kind, e.Limit)
+}
+
+type limiter struct {
+	limits  Limits
+	entries int64
+	size    int64
+	data    int64
+}
+
+func newLimiter(l *Limits) *limiter {
+	if l == nil {
+		return nil
+	}
+	return &limiter{limits: *l}
+}
+
+// check validates the next entry against the limits and accounts for it
+// if it is allowed. skip is returned if the handler chose to leave out the
+// entry.
+func (l *limiter) check(stat *types.Stat) (skip bool, err error) {
+	if l == nil {
+		return false, nil
+	}
+	var size int64
+	if fileCanRequestData(os.FileMode(stat.Mode)) {
+		size = stat.Size_
+	}
+
+	var xattrSize int64
+	for k, v := range stat.Xattrs {
+		xattrSize += int64(len(k) + len(v))
+	}
+
+	var lerr *LimitError
+	switch {
+	case l.limits.MaxPathLength > 0 && (len(stat.Path) > l.limits.MaxPathLength || len(stat.Linkname) > l.limits.MaxPathLength):
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxPathLength, Limit: int64(l.limits.MaxPathLength)}
+	case l.limits.MaxXattrSize > 0 && xattrSize > l.limits.MaxXattrSize:
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxXattrSize, Limit: l.limits.MaxXattrSize}
+	case l.limits.MaxDepth > 0 && strings.Count(stat.Path, "/") >= l.limits.MaxDepth:
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxDepth, Limit: int64(l.limits.MaxDepth)}
+	case l.limits.MaxFileSize > 0 && size > l.limits.MaxFileSize:
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxFileSize, Limit: l.limits.MaxFileSize}
+	case l.limits.MaxEntries > 0 && l.entries >= l.limits.MaxEntries:
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxEntries, Limit: l.limits.MaxEntries}
+	case l.limits.MaxTotalSize > 0 && l.size+size > l.limits.MaxTotalSize:
+		lerr = &LimitError{Path: stat.Path, Kind: LimitMaxTotalSize, Limit: l.limits.MaxTotalSize}
+	}
+	if lerr != nil {
+		if l.limits.Handler == nil {
+			return false, errors.WithStack(lerr)
+		}
+		if err := l.limits.Handler(lerr); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	l.entries++
+	l.size += size
+	return false, nil
+}
+
+// checkData validates file data that is actually transferred, so that a
+// sender can't bypass the limits by reporting wrong sizes. written is the
+// amount of data already received for p. Data can't be skipped, so
+// exceeding a limit is always an error.
+func (l *limiter) checkData(p string, written, n int64) error {
+	if l == nil {
+		return nil
+	}
+	if l.limits.MaxFileSize > 0 && written+n > l.limits.MaxFileSize {
+		return errors.WithStack(&LimitError{Path: p, Kind: LimitMaxFileSize, Limit: l.limits.MaxFileSize})
+	}
+	if l.limits.MaxTotalSize > 0 && l.data+n > l.limits.MaxTotalSize {
+		return errors.WithStack(&LimitError{Path: p, Kind: LimitMaxTotalSize, Limit: l.limits.MaxTotalSize})
+	}
+	l.data += n
+	return nil
+}
@@ -0,0 +1,134 @@
+package fsutil
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+)
+
+// NameLookup resolves user and group names. The methods return false if the
+// id or the name is unknown.
+type NameLookup interface {
+	UserName(uid uint32) (string, bool)
+	GroupName(gid uint32) (string, bool)
+	UserID(name string) (uint32, bool)
+	GroupID(name string) (uint32, bool)
+}
+
+// NewNameLookup returns a NameLookup for the etc/passwd and etc/group files
+// under root. Missing files are treated as empty.
+func NewNameLookup(root string) (NameLookup, error) {
+	users, err := parseIDFile(filepath.Join(root, "etc/passwd"))
+	if err != nil {
+		return nil, err
+	}
+	groups, err := parseIDFile(filepath.Join(root, "etc/group"))
+	if err != nil {
+		return nil, err
+	}
+	return &nameLookup{users: users, groups: groups}, nil
+}
+
+type idMap struct {
+	names map[uint32]string
+	ids   map[string]uint32
+}
+
+type nameLookup struct {
+	users  idMap
+	groups idMap
+}
+
+func (l *nameLookup) UserName(uid uint32) (string, bool) {
+	name, ok := l.users.names[uid]
+	return name, ok
+}
+
+func (l *nameLookup) GroupName(gid uint32) (string, bool) {
+	name, ok := l.groups.names[gid]
+	return name, ok
+}
+
+func (l *nameLookup) UserID(name string) (uint32, bool) {
+	id, ok := l.users.ids[name]
+	return id, ok
+}
+
+func (l *nameLookup) GroupID(name string) (uint32, bool) {
+	id, ok := l.groups.ids[name]
+	return id, ok
+}
+
+// parseIDFile reads the name and the id from the first two fields of a
+// passwd or group file. The first entry wins if names or ids are repeated.
+func parseIDFile(p string) (idMap, error) {
+	m := idMap{names: map[uint32]string{}, ids: map[string]uint32{}}
+	f, err := os.Open(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return m, nil
+		}
+		return m, errors.WithStack(err)
+	}
+	defer f.Close()
+	if err := parseIDs(f, m); err != nil {
+		return m, errors.Wrapf(err, "failed to parse %s", p)
+	}
+	return m, nil
+}
+
+func parseIDs(r io.Reader, m idMap) error {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		// skip comments and NIS entries
+		if line == "" || line[0] == '#' || line[0] == '+' || line[0] == '-' {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) < 3 || parts[0] == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, ok := m.names[uint32(id)]; !ok {
+			m.names[uint32(id)] = parts[0]
+		}
+		if _, ok := m.ids[parts[0]]; !ok {
+			m.ids[parts[0]] = uint32(id)
+		}
+	}
+	return s.Err()
+}
+
+// setNames sets the owner names of stat known to l
+func setNames(stat *types.Stat, l NameLookup) {
+	if name, ok := l.UserName(stat.Uid); ok {
+		stat.Uname = name
+	}
+	if name, ok := l.GroupName(stat.Gid); ok {
+		stat.Gname = name
+	}
+}
+
+// mapNames sets the owner ids of stat from its names if they are known to l
+func mapNames(stat *types.Stat, l NameLookup) {
+	if stat.Uname != "" {
+		if id, ok := l.UserID(stat.Uname); ok {
+			stat.Uid = id
+		}
+	}
+	if stat.Gname != "" {
+		if id, ok := l.GroupID(stat.Gname); ok {
+			stat.Gid = id
+		}
+	}
+}
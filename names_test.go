@@ -0,0 +1,101 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestParseIDs(t *testing.T) {
+	m := idMap{names: map[uint32]string{}, ids: map[string]uint32{}}
+	err := parseIDs(strings.NewReader(`# comment
+root:x:0:0:root:/root:/bin/sh
++nisuser::::::
+invalid:x:abc:0::/:/bin/sh
+toor:x:0:0::/root:/bin/sh
+user:x:1000:1000::/home/user:/bin/sh
+`), m)
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]string{0: "root", 1000: "user"}, m.names)
+	assert.Equal(t, map[string]uint32{"root": 0, "toor": 0, "user": 1000}, m.ids)
+}
+
+func TestSendReceiveNames(t *testing.T) {
+	requiresRoot(t)
+
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+		"ADD bar file data2",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+	require.NoError(t, os.Lchown(filepath.Join(d, "foo"), 1000, 1001))
+	require.NoError(t, os.Lchown(filepath.Join(d, "bar"), 1002, 1002))
+
+	lookup := func(passwd, group string) NameLookup {
+		root, err := ioutil.TempDir("", "root")
+		require.NoError(t, err)
+		defer os.RemoveAll(root)
+		require.NoError(t, os.MkdirAll(filepath.Join(root, "etc"), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc/passwd"), []byte(passwd), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, "etc/group"), []byte(group), 0644))
+		l, err := NewNameLookup(root)
+		require.NoError(t, err)
+		return l
+	}
+	srcLookup := lookup("user:x:1000:1000::/:/bin/sh\n", "user:x:1000:\nstaff:x:1001:\n")
+	dstLookup := lookup("user:x:2000:2000::/:/bin/sh\n", "staff:x:2001:\n")
+
+	fs := NewFS(d, &WalkOpt{NameLookup: srcLookup})
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTar(context.Background(), fs, buf))
+	tr := tar.NewReader(buf)
+	owners := map[string][2]string{}
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		owners[hdr.Name] = [2]string{hdr.Uname, hdr.Gname}
+	}
+	assert.Equal(t, map[string][2]string{"foo": {"user", "staff"}, "bar": {"", ""}}, owners)
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, fs, nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{NameLookup: dstLookup})
+	})
+	require.NoError(t, eg.Wait())
+
+	fi, err := os.Lstat(filepath.Join(dest, "foo"))
+	require.NoError(t, err)
+	st := fi.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(2000), st.Uid)
+	assert.Equal(t, uint32(2001), st.Gid)
+
+	// unknown names keep the numeric ids
+	fi, err = os.Lstat(filepath.Join(dest, "bar"))
+	require.NoError(t, err)
+	st = fi.Sys().(*syscall.Stat_t)
+	assert.Equal(t, uint32(1002), st.Uid)
+	assert.Equal(t, uint32(1002), st.Gid)
+}
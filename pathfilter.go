@@ -0,0 +1,124 @@
+package fsutil
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/fileutils"
+	"github.com/pkg/errors"
+)
+
+// PathFilter applies include and exclude patterns with the semantics of
+// WalkOpt.IncludePatterns and WalkOpt.ExcludePatterns. Paths are relative to
+// the root of the walk and need to be matched in the lexical order of
+// filepath.Walk. The contents of directories that do not match must be left
+// out by the caller.
+type PathFilter struct {
+	includePatterns []*includePattern
+	pm              *fileutils.PatternMatcher
+	// et and im are only set by Walk for tracing and ignore files
+	et *excludeTracer
+	im *ignoreMatcher
+
+	lastIncludedDir     string
+	lastIncludedPattern string
+}
+
+func NewPathFilter(includePatterns, excludePatterns []string) (*PathFilter, error) {
+	f := &PathFilter{}
+	if includePatterns != nil {
+		f.includePatterns = make([]*includePattern, len(includePatterns))
+		for k := range includePatterns {
+			f.includePatterns[k] = newIncludePattern(includePatterns[k])
+		}
+	}
+	if excludePatterns != nil {
+		pm, err := fileutils.NewPatternMatcher(excludePatterns)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid excludepatterns: %s", excludePatterns)
+		}
+		f.pm = pm
+	}
+	return f, nil
+}
+
+// Match returns true if path passes the patterns
+func (f *PathFilter) Match(path string, isDir bool) (bool, error) {
+	return f.match(path, isDir, &FilterTrace{})
+}
+
+// match returns true if path passes the patterns. The rule and pattern that
+// decided the result are set in tr.
+func (f *PathFilter) match(path string, isDir bool, tr *FilterTrace) (bool, error) {
+	if f.includePatterns != nil {
+		skip := false
+		if f.lastIncludedDir != "" {
+			if strings.HasPrefix(path, f.lastIncludedDir+string(filepath.Separator)) {
+				skip = true
+				tr.set(FilterRuleInclude, f.lastIncludedPattern, "")
+			}
+		}
+
+		if !skip {
+			matched, full, ip := matchIncludePatterns(f.includePatterns, path, isDir)
+			if ip != nil {
+				tr.set(FilterRuleInclude, ip.String(), "")
+			}
+			if !matched {
+				// no include pattern matched the path
+				tr.Rule = FilterRuleInclude
+				return false, nil
+			}
+			if full && isDir {
+				f.lastIncludedDir = path
+				f.lastIncludedPattern = tr.Pattern
+			}
+		}
+	}
+	if f.im != nil {
+		r, err := f.im.match(path, isDir)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to match ignore files")
+		}
+		if r != nil {
+			tr.set(FilterRuleIgnoreFile, r.pattern, r.source)
+			if !r.negate {
+				return false, nil
+			}
+		}
+	}
+	if f.pm != nil {
+		m, err := f.pm.Matches(path)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to match excludepatterns")
+		}
+		if f.et != nil {
+			pattern, err := f.et.match(path)
+			if err != nil {
+				return false, errors.Wrap(err, "failed to match excludepatterns")
+			}
+			if pattern != "" {
+				tr.set(FilterRuleExclude, pattern, "")
+			}
+		}
+
+		if m {
+			if !isDir || !f.pm.Exclusions() {
+				return false, nil
+			}
+			dirSlash := path + string(filepath.Separator)
+			for _, pat := range f.pm.Patterns() {
+				if !pat.Exclusion() {
+					continue
+				}
+				patStr := pat.String() + string(filepath.Separator)
+				if strings.HasPrefix(patStr, dirSlash) {
+					tr.set(FilterRuleExclude, excludePatternString(pat), "")
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
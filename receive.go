@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"os"
+	"strings"
 	"sync"
 
 	"github.com/pkg/errors"
@@ -17,6 +18,56 @@ type ReceiveOpt struct {
 	ProgressCb    func(int, bool)
 	Merge         bool
 	Filter        FilterFunc
+	// Limits restricts the entries and data accepted from the sender. If a
+	// limit is exceeded the entries created by the receive and the files
+	// that did not receive all of their data are removed. Entries that
+	// existed in dest are not restored, e.g. replaced files keep their new
+	// content.
+	Limits *Limits
+	// MaxOpenFiles limits the number of files that receive data
+	// concurrently
+	MaxOpenFiles int
+	// XattrFilter selects the extended attributes that are written
+	XattrFilter *XattrFilter
+	// XattrErrorHandler is called if an extended attribute can't be set.
+	// If it is not set, only failing to set security.capability is an
+	// error.
+	XattrErrorHandler XattrErrorHandler
+	// RestoreAccessTime sets the access times sent by the sender. The sender
+	// only sends them if it walks with WalkOpt.ExtendedStat.
+	RestoreAccessTime bool
+	// NameLookup maps the owner of the files by the user and group names
+	// sent by the sender instead of the numeric ids
+	NameLookup NameLookup
+	// InodeFlags controls how the inode flags are restored
+	InodeFlags InodeFlagsPolicy
+	// ContentStore provides the content for the digests sent by the sender
+	// so that it does not need to be requested. The sender is trusted to
+	// have that content, see ContentStore.
+	ContentStore ContentStore
+	// ReuseExisting takes the content for the digests sent by the sender
+	// from the existing files in dest. Existing files are hashed when a
+	// file with the same size is received. As with ContentStore, the sender
+	// can get the content of any file in dest whose digest it knows.
+	ReuseExisting bool
+	// Target creates the ReceiveTarget that the received files are written
+	// to. By default a DiskWriter for dest is used.
+	Target func(ctx context.Context, dest string, opt DiskWriterOpt) (ReceiveTarget, error)
+}
+
+// ReceiveTarget handles the changes received by Receive. DiskWriter and
+// StoreWriter implement it.
+type ReceiveTarget interface {
+	HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) error
+	// Wait waits for the data of all files and finishes the target
+	Wait(ctx context.Context) error
+	// Dir returns the directory that the files are written to or an empty
+	// string if the target does not write to a directory. Unless Merge is
+	// set, the files in it that were not sent are deleted.
+	Dir() string
+	// RemovePartial removes the files of an incomplete receive. It is
+	// called after Wait if the receive exceeded its limits.
+	RemovePartial() error
 }
 
 func Receive(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) error {
@@ -27,26 +78,50 @@ func Receive(ctx context.Context, conn Stream, dest string, opt ReceiveOpt) erro
 		conn:          &syncStream{Stream: conn},
 		dest:          dest,
 		files:         make(map[string]uint32),
-		pipes:         make(map[uint32]io.WriteCloser),
+		pipes:         make(map[uint32]*wrappedWriteCloser),
 		notifyHashed:  opt.NotifyHashed,
 		contentHasher: opt.ContentHasher,
 		progressCb:    opt.ProgressCb,
 		merge:         opt.Merge,
 		filter:        opt.Filter,
+		limiter:       newLimiter(opt.Limits),
+		maxOpenFiles:  opt.MaxOpenFiles,
+		xattrFilter:   opt.XattrFilter,
+		xattrHandler:  opt.XattrErrorHandler,
+		restoreAtime:  opt.RestoreAccessTime,
+		nameLookup:    opt.NameLookup,
+		inodeFlags:    opt.InodeFlags,
+		contentStore:  opt.ContentStore,
+		reuseTree:     opt.ReuseExisting,
+		target:        opt.Target,
 	}
 	return r.run(ctx)
 }
 
 type receiver struct {
-	dest       string
-	conn       Stream
-	files      map[string]uint32
-	pipes      map[uint32]io.WriteCloser
-	mu         sync.RWMutex
-	muPipes    sync.RWMutex
-	progressCb func(int, bool)
-	merge      bool
-	filter     FilterFunc
+	dest         string
+	conn         Stream
+	files        map[string]uint32
+	pipes        map[uint32]*wrappedWriteCloser
+	mu           sync.RWMutex
+	muPipes      sync.RWMutex
+	progressCb   func(int, bool)
+	merge        bool
+	filter       FilterFunc
+	limiter      *limiter
+	maxOpenFiles int
+	xattrFilter  *XattrFilter
+	xattrHandler XattrErrorHandler
+	restoreAtime bool
+	nameLookup   NameLookup
+	inodeFlags   InodeFlagsPolicy
+	contentStore ContentStore
+	reuseTree    bool
+	target       func(context.Context, string, DiskWriterOpt) (ReceiveTarget, error)
+	// skippedDir and skippedFiles track entries left out because of limits
+	// so that their children and hardlinks are left out as well
+	skippedDir   string
+	skippedFiles map[string]struct{}
 
 	notifyHashed   ChangeFunc
 	contentHasher  ContentHasher
@@ -110,12 +185,27 @@ func (w *dynamicWalker) fill(ctx context.Context, pathC chan<- *currentPath) err
 func (r *receiver) run(ctx context.Context) error {
 	g, ctx := errgroup.WithContext(ctx)
 
-	dw, err := NewDiskWriter(ctx, r.dest, DiskWriterOpt{
-		AsyncDataCb:   r.asyncDataFunc,
-		NotifyCb:      r.notifyHashed,
-		ContentHasher: r.contentHasher,
-		Filter:        r.filter,
-	})
+	dwOpt := DiskWriterOpt{
+		AsyncDataCb:       r.asyncDataFunc,
+		NotifyCb:          r.notifyHashed,
+		ContentHasher:     r.contentHasher,
+		Filter:            r.filter,
+		MaxOpenFiles:      r.maxOpenFiles,
+		XattrFilter:       r.xattrFilter,
+		XattrErrorHandler: r.xattrHandler,
+		RestoreAccessTime: r.restoreAtime,
+		NameLookup:        r.nameLookup,
+		InodeFlags:        r.inodeFlags,
+		ContentStore:      r.contentStore,
+		ReuseExisting:     r.reuseTree,
+	}
+	var dw ReceiveTarget
+	var err error
+	if r.target != nil {
+		dw, err = r.target(ctx, r.dest, dwOpt)
+	} else {
+		dw, err = NewDiskWriter(ctx, r.dest, dwOpt)
+	}
 	if err != nil {
 		return err
 	}
@@ -129,10 +219,10 @@ func (r *receiver) run(ctx context.Context) error {
 			}
 		}()
 		destWalker := emptyWalker
-		if !r.merge {
-			destWalker = getWalkerFn(r.dest)
+		if dir := dw.Dir(); !r.merge && dir != "" {
+			destWalker = getWalkerFn(dir)
 		}
-		err := doubleWalkDiff(ctx, dw.HandleChange, destWalker, w.fill, r.filter)
+		err := doubleWalkDiff(ctx, dw.HandleChange, destWalker, w.fill, r.filter, false)
 		if err != nil {
 			return err
 		}
@@ -143,7 +233,13 @@ func (r *receiver) run(ctx context.Context) error {
 		return nil
 	})
 
-	g.Go(func() error {
+	g.Go(func() (retErr error) {
+		defer func() {
+			var lerr *LimitError
+			if errors.As(retErr, &lerr) {
+				r.conn.SendMsg(&types.Packet{Type: types.PACKET_ERR, Data: []byte(retErr.Error())})
+			}
+		}()
 		var i uint32 = 0
 
 		size := 0
@@ -173,11 +269,7 @@ func (r *receiver) run(ctx context.Context) error {
 					}
 					break
 				}
-				if fileCanRequestData(os.FileMode(p.Stat.Mode)) {
-					r.mu.Lock()
-					r.files[p.Stat.Path] = i
-					r.mu.Unlock()
-				}
+				id := i
 				i++
 				cp := &currentPath{path: p.Stat.Path, stat: p.Stat}
 				if err := r.orderValidator.HandleChange(ChangeKindAdd, cp.path, &StatInfo{cp.stat}, nil); err != nil {
@@ -186,6 +278,16 @@ func (r *receiver) run(ctx context.Context) error {
 				if err := r.hlValidator.HandleChange(ChangeKindAdd, cp.path, &StatInfo{cp.stat}, nil); err != nil {
 					return err
 				}
+				if skip, err := r.checkLimits(cp.stat); err != nil {
+					return err
+				} else if skip {
+					break
+				}
+				if fileCanRequestData(os.FileMode(p.Stat.Mode)) {
+					r.mu.Lock()
+					r.files[p.Stat.Path] = id
+					r.mu.Unlock()
+				}
 				if err := w.update(cp); err != nil {
 					return err
 				}
@@ -201,10 +303,31 @@ func (r *receiver) run(ctx context.Context) error {
 						return err
 					}
 				} else {
+					if err := r.limiter.checkData(pw.path, pw.written, int64(len(p.Data))); err != nil {
+						return err
+					}
+					pw.written += int64(len(p.Data))
 					if _, err := pw.Write(p.Data); err != nil {
 						return err
 					}
 				}
+			case types.PACKET_HOLE:
+				r.muPipes.Lock()
+				pw, ok := r.pipes[p.ID]
+				r.muPipes.Unlock()
+				if !ok {
+					return errors.Errorf("invalid file request %d", p.ID)
+				}
+				if p.Size_ < 0 {
+					return errors.Errorf("invalid hole size %d for %s", p.Size_, pw.path)
+				}
+				if err := r.limiter.checkData(pw.path, pw.written, p.Size_); err != nil {
+					return err
+				}
+				pw.written += p.Size_
+				if err := pw.WriteHole(p.Size_); err != nil {
+					return err
+				}
 			case types.PACKET_FIN:
 				for {
 					var p types.Packet
@@ -218,7 +341,47 @@ func (r *receiver) run(ctx context.Context) error {
 			}
 		}
 	})
-	return g.Wait()
+
+	err = g.Wait()
+	var lerr *LimitError
+	if errors.As(err, &lerr) {
+		dw.Wait(ctx)
+		if err := dw.RemovePartial(); err != nil {
+			return errors.Wrapf(err, "failed to clean up after %v", lerr)
+		}
+	}
+	return err
+}
+
+// checkLimits returns true if the entry should be left out because it, its
+// parent directory or its hardlink source exceeded the limits
+func (r *receiver) checkLimits(st *types.Stat) (bool, error) {
+	if r.limiter == nil {
+		return false, nil
+	}
+	if r.skippedDir != "" && strings.HasPrefix(st.Path, r.skippedDir+"/") {
+		return true, nil
+	}
+	mode := os.FileMode(st.Mode)
+	if st.Linkname != "" && mode&os.ModeSymlink == 0 {
+		if _, ok := r.skippedFiles[st.Linkname]; ok {
+			r.skippedFiles[st.Path] = struct{}{}
+			return true, nil
+		}
+	}
+	skip, err := r.limiter.check(st)
+	if err != nil || !skip {
+		return false, err
+	}
+	if mode.IsDir() {
+		r.skippedDir = st.Path
+	} else {
+		if r.skippedFiles == nil {
+			r.skippedFiles = make(map[string]struct{})
+		}
+		r.skippedFiles[st.Path] = struct{}{}
+	}
+	return true, nil
 }
 
 func (r *receiver) asyncDataFunc(ctx context.Context, p string, wc io.WriteCloser) error {
@@ -232,10 +395,11 @@ func (r *receiver) asyncDataFunc(ctx context.Context, p string, wc io.WriteClose
 	r.mu.Unlock()
 
 	wwc := newWrappedWriteCloser(wc)
+	wwc.path = p
 	r.muPipes.Lock()
 	r.pipes[id] = wwc
 	r.muPipes.Unlock()
-	if err := r.conn.SendMsg(&types.Packet{Type: types.PACKET_REQ, ID: id}); err != nil {
+	if err := r.conn.SendMsg(&types.Packet{Type: types.PACKET_REQ, ID: id, Sparse: true}); err != nil {
 		return err
 	}
 	err := wwc.Wait(ctx)
@@ -253,6 +417,9 @@ type wrappedWriteCloser struct {
 	err  error
 	once sync.Once
 	done chan struct{}
+
+	path    string
+	written int64
 }
 
 func newWrappedWriteCloser(wc io.WriteCloser) *wrappedWriteCloser {
@@ -265,6 +432,10 @@ func (w *wrappedWriteCloser) Close() error {
 	return w.err
 }
 
+func (w *wrappedWriteCloser) WriteHole(n int64) error {
+	return writeHole(w.WriteCloser, n)
+}
+
 func (w *wrappedWriteCloser) Wait(ctx context.Context) error {
 	select {
 	case <-ctx.Done():
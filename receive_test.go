@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
@@ -342,6 +343,106 @@ file zzz.aa
 	assert.Equal(t, ok, false)
 }
 
+func TestReceiveLimits(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data1",
+		"ADD foo dir",
+		"ADD foo/bar file data2",
+		"ADD foo/sub dir",
+		"ADD foo/sub/baz file data3",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receiveWithOpt := func(dest string, walkOpt *WalkOpt, opt ReceiveOpt) error {
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, NewFS(d, walkOpt), nil)
+		})
+		var recvErr error
+		eg.Go(func() error {
+			opt.Filter = func(_ string, s *types.Stat) bool {
+				s.Uid = uint32(os.Getuid())
+				s.Gid = uint32(os.Getgid())
+				return true
+			}
+			recvErr = Receive(ctx, s2, dest, opt)
+			return recvErr
+		})
+		err := eg.Wait()
+		if recvErr != nil {
+			return recvErr
+		}
+		return err
+	}
+
+	receive := func(dest string, walkOpt *WalkOpt, limits *Limits) error {
+		return receiveWithOpt(dest, walkOpt, ReceiveOpt{Limits: limits})
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	var skipped []string
+	err = receive(dest, nil, &Limits{
+		MaxDepth: 2,
+		Handler: func(err *LimitError) error {
+			skipped = append(skipped, err.Path)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo/sub/baz"}, skipped)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), dest, nil, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/bar
+dir foo/sub
+`, string(b.Bytes()))
+
+	// sender reporting wrong sizes can't bypass the limits
+	dest2, err := ioutil.TempDir("", "dest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dest2)
+
+	err = receive(dest2, &WalkOpt{
+		Map: func(_ string, s *types.Stat) bool {
+			s.Size_ = 0
+			return true
+		},
+	}, &Limits{MaxTotalSize: 12})
+	require.Error(t, err)
+	var lerr *LimitError
+	require.True(t, errors.As(err, &lerr))
+	assert.Equal(t, LimitMaxTotalSize, lerr.Kind)
+
+	// partial output is removed
+	fis, err := ioutil.ReadDir(dest2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(fis))
+
+	err = receive(dest2, nil, &Limits{MaxPathLength: 8})
+	require.True(t, errors.As(err, &lerr))
+	assert.Equal(t, LimitMaxPathLength, lerr.Kind)
+	assert.Equal(t, "foo/sub/baz", lerr.Path)
+	fis, err = ioutil.ReadDir(dest2)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(fis))
+
+	err = receiveWithOpt(dest2, nil, ReceiveOpt{MaxOpenFiles: 1})
+	require.NoError(t, err)
+	dt, err := ioutil.ReadFile(filepath.Join(dest2, "foo/sub/baz"))
+	require.NoError(t, err)
+	assert.Equal(t, "data3", string(dt))
+}
+
 func sockPairProto(ctx context.Context) (Stream, Stream) {
 	c1 := make(chan []byte, 32)
 	c2 := make(chan []byte, 32)
@@ -467,3 +568,181 @@ func simpleSHA256Hasher(s *types.Stat) (hash.Hash, error) {
 	h.Write(dt)
 	return h, nil
 }
+
+func TestReceiveAccessTime(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+		"ADD zzz dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	atime := time.Unix(1500000000, 0)
+	mtime := time.Unix(1600000000, 0)
+	err = os.Chtimes(filepath.Join(d, "foo"), atime, mtime)
+	require.NoError(t, err)
+
+	receive := func(dest string, restore bool) map[string]*types.Stat {
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, NewFS(d, &WalkOpt{BirthTime: true, ExtendedStat: true}), nil)
+		})
+		var mu sync.Mutex
+		stats := map[string]*types.Stat{}
+		eg.Go(func() error {
+			return Receive(ctx, s2, dest, ReceiveOpt{
+				Filter: func(p string, s *types.Stat) bool {
+					s.Uid = uint32(os.Getuid())
+					s.Gid = uint32(os.Getgid())
+					mu.Lock()
+					st := *s
+					stats[p] = &st
+					mu.Unlock()
+					return true
+				},
+				RestoreAccessTime: restore,
+			})
+		})
+		require.NoError(t, eg.Wait())
+		return stats
+	}
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	stats := receive(dest, true)
+	require.Contains(t, stats, "foo")
+	assert.Equal(t, atime.UnixNano(), stats["foo"].AccessTime)
+	assert.NotZero(t, stats["foo"].ChangeTime)
+	assert.NotZero(t, stats["foo"].Ino)
+	assert.Equal(t, uint64(1), stats["foo"].Nlink)
+
+	st := extendedStat(t, filepath.Join(dest, "foo"))
+	assert.Equal(t, atime.UnixNano(), st.AccessTime)
+	assert.Equal(t, mtime.UnixNano(), st.ModTime)
+
+	// without RestoreAccessTime the access time matches the modification time
+	dest2, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest2)
+
+	receive(dest2, false)
+	st = extendedStat(t, filepath.Join(dest2, "foo"))
+	assert.Equal(t, mtime.UnixNano(), st.AccessTime)
+}
+
+func TestReceiveMaxOpenFiles(t *testing.T) {
+	// more files than the receiver buffers while the data of the file in
+	// progress is still being received
+	var files []string
+	for i := 0; i < 300; i++ {
+		files = append(files, fmt.Sprintf("ADD f%03d file data%d", i, i))
+	}
+	d, err := tmpDir(changeStream(files))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, nil), nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{
+			MaxOpenFiles: 1,
+			Filter: func(_ string, s *types.Stat) bool {
+				s.Uid = uint32(os.Getuid())
+				s.Gid = uint32(os.Getgid())
+				return true
+			},
+		})
+	})
+	require.NoError(t, eg.Wait())
+
+	fis, err := ioutil.ReadDir(dest)
+	require.NoError(t, err)
+	assert.Equal(t, 300, len(fis))
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "f299"))
+	require.NoError(t, err)
+	assert.Equal(t, "data299", string(dt))
+}
+
+// deleteRecorder is a ReceiveTarget that records the deleted paths
+type deleteRecorder struct {
+	*DiskWriter
+	mu      sync.Mutex
+	deleted []string
+}
+
+func (r *deleteRecorder) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) error {
+	if kind == ChangeKindDelete {
+		r.mu.Lock()
+		r.deleted = append(r.deleted, p)
+		r.mu.Unlock()
+	}
+	return r.DiskWriter.HandleChange(kind, p, fi, err)
+}
+
+func TestReceiveTargetDeletes(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(merge bool) ([]string, []string) {
+		dest, err := tmpDir(changeStream([]string{
+			"ADD bar file data2",
+			"ADD foo file data1",
+		}))
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		var target *deleteRecorder
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, NewFS(d, nil), nil)
+		})
+		eg.Go(func() error {
+			return Receive(ctx, s2, dest, ReceiveOpt{
+				Merge: merge,
+				Target: func(ctx context.Context, dest string, opt DiskWriterOpt) (ReceiveTarget, error) {
+					dw, err := NewDiskWriter(ctx, dest, opt)
+					if err != nil {
+						return nil, err
+					}
+					target = &deleteRecorder{DiskWriter: dw}
+					return target, nil
+				},
+			})
+		})
+		require.NoError(t, eg.Wait())
+
+		var files []string
+		fis, err := ioutil.ReadDir(dest)
+		require.NoError(t, err)
+		for _, fi := range fis {
+			files = append(files, fi.Name())
+		}
+		return target.deleted, files
+	}
+
+	deleted, files := receive(false)
+	assert.Equal(t, []string{"bar"}, deleted)
+	assert.Equal(t, []string{"foo"}, files)
+
+	deleted, files = receive(true)
+	assert.Nil(t, deleted)
+	assert.Equal(t, []string{"bar", "foo"}, files)
+}
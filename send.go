@@ -7,6 +7,7 @@ import (
 	"sync"
 	"syscall"
 
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/tonistiigi/fsutil/types"
 	"golang.org/x/sync/errgroup"
@@ -25,20 +26,58 @@ type Stream interface {
 	Context() context.Context
 }
 
+// SendOpt configures SendWithOpt
+type SendOpt struct {
+	ProgressCb func(int, bool)
+	// ContentDigester returns the digest that is sent with the stat of a
+	// regular file. The receiver can use it to take the content from a
+	// local copy instead of requesting it.
+	ContentDigester ContentDigester
+}
+
+// ContentDigester returns the digest of the content of the regular file at
+// path
+type ContentDigester func(ctx context.Context, path string, st *types.Stat) (digest.Digest, error)
+
+// FSDigester returns a ContentDigester that computes the sha256 digest of
+// the files in fs
+func FSDigester(fs FS) ContentDigester {
+	return func(ctx context.Context, path string, _ *types.Stat) (digest.Digest, error) {
+		rc, err := fs.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		buf := bufPool.Get().(*[]byte)
+		defer bufPool.Put(buf)
+		h := digest.SHA256.Hash()
+		if _, err := io.CopyBuffer(h, rc, *buf); err != nil {
+			return "", errors.Wrapf(err, "failed to digest %s", path)
+		}
+		return digest.NewDigest(digest.SHA256, h), nil
+	}
+}
+
 func Send(ctx context.Context, conn Stream, fs FS, progressCb func(int, bool)) error {
+	return SendWithOpt(ctx, conn, fs, SendOpt{ProgressCb: progressCb})
+}
+
+func SendWithOpt(ctx context.Context, conn Stream, fs FS, opt SendOpt) error {
 	s := &sender{
 		conn:         &syncStream{Stream: conn},
 		fs:           fs,
 		files:        make(map[uint32]string),
-		progressCb:   progressCb,
+		progressCb:   opt.ProgressCb,
+		digester:     opt.ContentDigester,
 		sendpipeline: make(chan *sendHandle, 128),
 	}
 	return s.run(ctx)
 }
 
 type sendHandle struct {
-	id   uint32
-	path string
+	id     uint32
+	path   string
+	sparse bool
 }
 
 type sender struct {
@@ -48,6 +87,7 @@ type sender struct {
 	mu              sync.RWMutex
 	progressCb      func(int, bool)
 	progressCurrent int
+	digester        ContentDigester
 	sendpipeline    chan *sendHandle
 }
 
@@ -97,7 +137,7 @@ func (s *sender) run(ctx context.Context) error {
 			case types.PACKET_ERR:
 				return errors.Errorf("error from receiver: %s", p.Data)
 			case types.PACKET_REQ:
-				if err := s.queue(p.ID); err != nil {
+				if err := s.queue(p.ID, p.Sparse); err != nil {
 					return err
 				}
 			case types.PACKET_FIN:
@@ -116,7 +156,7 @@ func (s *sender) updateProgress(size int, last bool) {
 	}
 }
 
-func (s *sender) queue(id uint32) error {
+func (s *sender) queue(id uint32, sparse bool) error {
 	s.mu.Lock()
 	p, ok := s.files[id]
 	if !ok {
@@ -125,7 +165,7 @@ func (s *sender) queue(id uint32) error {
 	}
 	delete(s.files, id)
 	s.mu.Unlock()
-	s.sendpipeline <- &sendHandle{id, p}
+	s.sendpipeline <- &sendHandle{id, p, sparse}
 	return nil
 }
 
@@ -135,7 +175,17 @@ func (s *sender) sendFile(h *sendHandle) error {
 		defer f.Close()
 		buf := bufPool.Get().(*[]byte)
 		defer bufPool.Put(buf)
-		if _, err := io.CopyBuffer(&fileSender{sender: s, id: h.id}, f, *buf); err != nil {
+		fs := &fileSender{sender: s, id: h.id}
+		if file, ok := f.(*os.File); ok && h.sparse {
+			sent, err := copySparse(fs, file, *buf)
+			if err != nil {
+				return err
+			}
+			if sent {
+				return s.conn.SendMsg(&types.Packet{ID: h.id, Type: types.PACKET_DATA})
+			}
+		}
+		if _, err := io.CopyBuffer(fs, f, *buf); err != nil {
 			return err
 		}
 	}
@@ -153,6 +203,14 @@ func (s *sender) walk(ctx context.Context) error {
 			return errors.WithStack(&os.PathError{Path: path, Err: syscall.EBADMSG, Op: "fileinfo without stat info"})
 		}
 
+		if s.digester != nil && fileCanRequestData(os.FileMode(stat.Mode)) && stat.Linkname == "" {
+			dgst, err := s.digester(ctx, path, stat)
+			if err != nil {
+				return err
+			}
+			stat.Digest = dgst.String()
+		}
+
 		p := &types.Packet{
 			Type: types.PACKET_STAT,
 			Stat: stat,
@@ -195,6 +253,15 @@ func (fs *fileSender) Write(dt []byte) (int, error) {
 	return len(dt), nil
 }
 
+func (fs *fileSender) WriteHole(n int64) error {
+	p := &types.Packet{Type: types.PACKET_HOLE, ID: fs.id, Size_: n}
+	if err := fs.sender.conn.SendMsg(p); err != nil {
+		return err
+	}
+	fs.sender.updateProgress(p.Size(), false)
+	return nil
+}
+
 type syncStream struct {
 	Stream
 	mu sync.Mutex
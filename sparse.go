@@ -0,0 +1,180 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/internal/sparse"
+)
+
+// sparseWriter is implemented by writers that can skip over a hole instead
+// of writing zeros
+type sparseWriter interface {
+	io.Writer
+	WriteHole(int64) error
+}
+
+var zeroBuf = make([]byte, 32*1<<10)
+
+// writeHole skips n bytes in w, writing zeros if w doesn't support holes
+func writeHole(w io.Writer, n int64) error {
+	if sw, ok := w.(sparseWriter); ok {
+		return sw.WriteHole(n)
+	}
+	return writeZeros(w, n)
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	for n > 0 {
+		b := zeroBuf
+		if n < int64(len(b)) {
+			b = b[:n]
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		n -= int64(len(b))
+	}
+	return nil
+}
+
+// copySparse copies the data regions of src to w and reports the holes
+// between them with WriteHole. It returns false without writing anything
+// if src does not contain holes.
+func copySparse(w sparseWriter, src *os.File, buf []byte) (bool, error) {
+	fi, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	extents, err := sparse.DataExtents(src, fi)
+	if err != nil || extents == nil {
+		return false, err
+	}
+	var off int64
+	for _, e := range extents {
+		if e.Offset > off {
+			if err := w.WriteHole(e.Offset - off); err != nil {
+				return true, err
+			}
+		}
+		if _, err := io.CopyBuffer(w, io.NewSectionReader(src, e.Offset, e.Length), buf); err != nil {
+			return true, err
+		}
+		off = e.Offset + e.Length
+	}
+	if size := fi.Size(); size > off {
+		if err := w.WriteHole(size - off); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// sparseKeyPrefix replaces "GNU.sparse." in the records passed to
+// archive/tar, which drops GNU.sparse records. It has the same length so that
+// the records can be renamed in the formatted header.
+const sparseKeyPrefix = "GNU_sparse."
+
+const blockSize = 512
+
+// writeSparseFile writes hdr and the extents of f as a PAX GNU sparse 1.0
+// entry. The entry is written directly to w as tar.Writer can't write the
+// data of sparse files.
+func writeSparseFile(w io.Writer, tw *tar.Writer, hdr *tar.Header, f *os.File, extents []sparse.Extent) error {
+	var b bytes.Buffer
+	var dataSize int64
+	// a trailing empty extent marks the real end of the file
+	fmt.Fprintf(&b, "%d\n", len(extents)+1)
+	for _, e := range extents {
+		fmt.Fprintf(&b, "%d\n%d\n", e.Offset, e.Length)
+		dataSize += e.Length
+	}
+	fmt.Fprintf(&b, "%d\n%d\n", hdr.Size, 0)
+	if n := b.Len() % blockSize; n != 0 {
+		b.Write(make([]byte, blockSize-n))
+	}
+
+	h := *hdr
+	h.PAXRecords = map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		h.PAXRecords[k] = v
+	}
+	h.PAXRecords[sparseKeyPrefix+"major"] = "1"
+	h.PAXRecords[sparseKeyPrefix+"minor"] = "0"
+	h.PAXRecords[sparseKeyPrefix+"name"] = hdr.Name
+	h.PAXRecords[sparseKeyPrefix+"realsize"] = strconv.FormatInt(hdr.Size, 10)
+	dir, file := path.Split(hdr.Name)
+	h.Name = path.Join(dir, "GNUSparseFile.0", file)
+	h.Size = int64(b.Len()) + dataSize
+	h.Format = tar.FormatPAX
+
+	var hb bytes.Buffer
+	if err := tar.NewWriter(&hb).WriteHeader(&h); err != nil {
+		return errors.Wrapf(err, "failed to write file header %s", hdr.Name)
+	}
+	if err := renameSparseRecords(hb.Bytes()); err != nil {
+		return errors.Wrapf(err, "failed to write file header %s", hdr.Name)
+	}
+
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(hb.Bytes()); err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, e := range extents {
+		n, err := io.Copy(w, io.NewSectionReader(f, e.Offset, e.Length))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n != e.Length {
+			return errors.Wrapf(io.ErrUnexpectedEOF, "%s changed while writing", hdr.Name)
+		}
+	}
+	if n := h.Size % blockSize; n != 0 {
+		if _, err := w.Write(make([]byte, blockSize-n)); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// renameSparseRecords renames the records with sparseKeyPrefix in the PAX
+// header at the start of hdrs to GNU.sparse records
+func renameSparseRecords(hdrs []byte) error {
+	if len(hdrs) < blockSize || hdrs[156] != tar.TypeXHeader {
+		return errors.New("missing PAX header")
+	}
+	size, err := strconv.ParseInt(strings.Trim(string(hdrs[124:136]), " \x00"), 8, 64)
+	if err != nil || blockSize+size > int64(len(hdrs)) {
+		return errors.New("invalid PAX header size")
+	}
+	recs := hdrs[blockSize : blockSize+size]
+	for len(recs) > 0 {
+		// records are formatted as "%d %s=%s\n" where the length includes
+		// itself
+		sp := bytes.IndexByte(recs, ' ')
+		if sp < 0 {
+			return errors.New("invalid PAX record")
+		}
+		n, err := strconv.Atoi(string(recs[:sp]))
+		if err != nil || n <= sp || n > len(recs) {
+			return errors.New("invalid PAX record")
+		}
+		if key := recs[sp+1 : n]; bytes.HasPrefix(key, []byte(sparseKeyPrefix)) {
+			copy(key, "GNU.sparse.")
+		}
+		recs = recs[n:]
+	}
+	return nil
+}
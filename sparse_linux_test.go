@@ -0,0 +1,144 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestSendReceiveSparse(t *testing.T) {
+	d, err := ioutil.TempDir("", "sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	expected := createSparseFile(t, filepath.Join(d, "foo"))
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, nil), nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{})
+	})
+	require.NoError(t, eg.Wait())
+
+	dt, err := ioutil.ReadFile(filepath.Join(dest, "foo"))
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, dt))
+
+	fi, err := os.Stat(filepath.Join(dest, "foo"))
+	require.NoError(t, err)
+	assert.True(t, fi.Sys().(*syscall.Stat_t).Blocks*512 < fi.Size())
+}
+
+func TestWriteTarSparse(t *testing.T) {
+	d, err := ioutil.TempDir("", "sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	expected := createSparseFile(t, filepath.Join(d, "foo"))
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTar(context.Background(), NewFS(d, nil), buf))
+
+	tr := tar.NewReader(buf)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "foo", hdr.Name)
+	assert.Equal(t, int64(len(expected)), hdr.Size)
+	assert.Less(t, int64(buf.Len()), hdr.Size)
+
+	dt, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, dt))
+
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWriteTarSparseLongNames(t *testing.T) {
+	d, err := ioutil.TempDir("", "sparse")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	dir := strings.Repeat("a", 60) + "/" + strings.Repeat("b", 60)
+	require.NoError(t, os.MkdirAll(filepath.Join(d, dir), 0700))
+	name := dir + "/" + strings.Repeat("c", 60)
+	expected := createSparseFile(t, filepath.Join(d, name))
+
+	uname := strings.Repeat("u", 40)
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTar(context.Background(), NewFS(d, &WalkOpt{
+		Map: func(_ string, s *types.Stat) bool {
+			s.Uname = uname
+			s.Gname = uname
+			return true
+		},
+	}), buf))
+
+	tr := tar.NewReader(buf)
+	var hdr *tar.Header
+	for {
+		hdr, err = tr.Next()
+		require.NoError(t, err)
+		if hdr.Typeflag == tar.TypeReg {
+			break
+		}
+	}
+	assert.Equal(t, name, hdr.Name)
+	assert.Equal(t, uname, hdr.Uname)
+	assert.Equal(t, uname, hdr.Gname)
+	assert.Equal(t, int64(len(expected)), hdr.Size)
+
+	dt, err := ioutil.ReadAll(tr)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(expected, dt))
+
+	_, err = tr.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+// createSparseFile creates a file with holes at the start, in the middle and
+// at the end and returns its content. The test is skipped if the filesystem
+// does not support holes.
+func createSparseFile(t *testing.T, p string) []byte {
+	const size = 4 << 20
+	f, err := os.Create(p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	require.NoError(t, f.Truncate(size))
+	expected := make([]byte, size)
+	for _, off := range []int64{1 << 20, 2 << 20} {
+		data := bytes.Repeat([]byte("data"), 1024)
+		_, err := f.WriteAt(data, off)
+		require.NoError(t, err)
+		copy(expected[off:], data)
+	}
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	if fi.Sys().(*syscall.Stat_t).Blocks*512 >= fi.Size() {
+		t.Skip("filesystem does not support sparse files")
+	}
+	return expected
+}
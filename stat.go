@@ -14,8 +14,9 @@ import (
 // relative to whatever base dir is relevant). fi is the os.Stat
 // info. inodemap is used to calculate hardlinks over a series of
 // mkstat calls and maps inode to the canonical (aka "first") path for
-// a set of hardlinks to that inode.
-func mkstat(path, relpath string, fi os.FileInfo, inodemap map[uint64]string) (*types.Stat, error) {
+// a set of hardlinks to that inode. opt selects the extended attributes
+// and the optional fields that are loaded.
+func mkstat(path, relpath string, fi os.FileInfo, inodemap map[uint64]string, opt *WalkOpt) (*types.Stat, error) {
 	relpath = filepath.ToSlash(relpath)
 
 	stat := &types.Stat{
@@ -36,7 +37,29 @@ func mkstat(path, relpath string, fi os.FileInfo, inodemap map[uint64]string) (*
 			stat.Linkname = link
 		}
 	}
-	if err := loadXattr(path, stat); err != nil {
+	var xattrFilter *XattrFilter
+	if opt != nil {
+		xattrFilter = opt.XattrFilter
+		if opt.NameLookup != nil && runtime.GOOS != "windows" {
+			setNames(stat, opt.NameLookup)
+		}
+		if opt.InodeFlags && (fi.Mode().IsRegular() || fi.IsDir()) {
+			flags, err := GetInodeFlags(path)
+			if err != nil {
+				return nil, err
+			}
+			stat.Flags = flags
+		}
+		if opt.ExtendedStat {
+			setExtendedStat(fi, stat)
+		}
+		if opt.BirthTime {
+			if err := loadBirthTime(path, fi, stat); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := loadXattr(path, stat, xattrFilter); err != nil {
 		return nil, err
 	}
 
@@ -60,5 +83,5 @@ func Stat(path string) (*types.Stat, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return mkstat(path, filepath.Base(path), fi, nil)
+	return mkstat(path, filepath.Base(path), fi, nil, nil)
 }
@@ -3,9 +3,12 @@ package fsutil
 import (
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tonistiigi/fsutil/types"
 )
 
@@ -54,3 +57,97 @@ func TestStat(t *testing.T) {
 	st.ModTime = 0
 	assert.Equal(t, &types.Stat{Path: "sock", Mode: 0755 /* ModeSocket not set */}, st)
 }
+
+// extendedStat returns the stat of p with the fields loaded by
+// WalkOpt.ExtendedStat
+func extendedStat(t *testing.T, p string) *types.Stat {
+	fi, err := os.Lstat(p)
+	require.NoError(t, err)
+	st, err := mkstat(p, filepath.Base(p), fi, nil, &WalkOpt{ExtendedStat: true, BirthTime: true})
+	require.NoError(t, err)
+	return st
+}
+
+func TestStatTimes(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+		"ADD bar dir",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	atime := time.Unix(1500000000, 100)
+	mtime := time.Unix(1600000000, 200)
+	err = os.Chtimes(filepath.Join(d, "foo"), atime, mtime)
+	assert.NoError(t, err)
+	err = os.Link(filepath.Join(d, "foo"), filepath.Join(d, "bar/foo"))
+	assert.NoError(t, err)
+
+	fi, err := os.Lstat(filepath.Join(d, "foo"))
+	assert.NoError(t, err)
+
+	st := extendedStat(t, filepath.Join(d, "foo"))
+	assert.Equal(t, atime.UnixNano(), st.AccessTime)
+	assert.Equal(t, mtime.UnixNano(), st.ModTime)
+	assert.Equal(t, fi.Sys().(*syscall.Stat_t).Ino, st.Ino)
+	assert.Equal(t, uint64(2), st.Nlink)
+
+	si := &StatInfo{st}
+	assert.True(t, atime.Equal(si.AccessTime()))
+	assert.False(t, si.ChangeTime().IsZero())
+	assert.Equal(t, st.BirthTime == 0, si.BirthTime().IsZero())
+}
+
+func TestSameFileExtendedStat(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "foo")
+	plain, err := Stat(p)
+	require.NoError(t, err)
+	assert.Zero(t, plain.AccessTime)
+	assert.Zero(t, plain.ChangeTime)
+	assert.Zero(t, plain.Ino)
+	assert.Zero(t, plain.Nlink)
+	extended := extendedStat(t, p)
+
+	// changes the change time but keeps the stat otherwise
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, os.Chmod(p, 0600))
+	require.NoError(t, os.Chmod(p, 0644))
+
+	plain2, err := Stat(p)
+	require.NoError(t, err)
+	same, err := sameFile(&currentPath{path: "foo", stat: plain}, &currentPath{path: "foo", stat: plain2}, true)
+	require.NoError(t, err)
+	assert.True(t, same)
+
+	extended2 := extendedStat(t, p)
+	same, err = sameFile(&currentPath{path: "foo", stat: extended}, &currentPath{path: "foo", stat: extended2}, false)
+	require.NoError(t, err)
+	assert.True(t, same)
+
+	same, err = sameFile(&currentPath{path: "foo", stat: extended}, &currentPath{path: "foo", stat: extended2}, true)
+	require.NoError(t, err)
+	assert.False(t, same)
+
+	// only compared if both sides have them
+	same, err = sameFile(&currentPath{path: "foo", stat: extended}, &currentPath{path: "foo", stat: plain2}, true)
+	require.NoError(t, err)
+	assert.True(t, same)
+
+	// a copy in another tree has a different inode number
+	d2, err := tmpDir(changeStream([]string{
+		"ADD foo file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d2)
+	p2 := filepath.Join(d2, "foo")
+	require.NoError(t, os.Chtimes(p2, time.Unix(0, extended2.ModTime), time.Unix(0, extended2.ModTime)))
+	same, err = sameFile(&currentPath{path: "foo", stat: extended2}, &currentPath{path: "foo", stat: extendedStat(t, p2)}, false)
+	require.NoError(t, err)
+	assert.True(t, same)
+}
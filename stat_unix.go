@@ -11,7 +11,7 @@ import (
 	"github.com/tonistiigi/fsutil/types"
 )
 
-func loadXattr(origpath string, stat *types.Stat) error {
+func loadXattr(origpath string, stat *types.Stat, filter *XattrFilter) error {
 	xattrs, err := sysx.LListxattr(origpath)
 	if err != nil {
 		if errors.Is(err, syscall.ENOTSUP) {
@@ -22,12 +22,17 @@ func loadXattr(origpath string, stat *types.Stat) error {
 	if len(xattrs) > 0 {
 		m := make(map[string][]byte)
 		for _, key := range xattrs {
+			if !filter.Match(key) {
+				continue
+			}
 			v, err := sysx.LGetxattr(origpath, key)
 			if err == nil {
 				m[key] = v
 			}
 		}
-		stat.Xattrs = m
+		if len(m) > 0 {
+			stat.Xattrs = m
+		}
 	}
 	return nil
 }
@@ -69,3 +74,20 @@ func major(device uint64) uint64 {
 func minor(device uint64) uint64 {
 	return (device & 0xff) | ((device >> 12) & 0xfff00)
 }
+
+func setExtendedStat(fi os.FileInfo, stat *types.Stat) {
+	s := fi.Sys().(*syscall.Stat_t)
+
+	stat.Ino = uint64(s.Ino)
+	stat.Nlink = uint64(s.Nlink)
+	setStatTimes(s, stat)
+}
+
+// forgetHardlink removes path as the source of the hardlinks to its inode
+// after it was left out of a walk, so that the next link becomes the source
+func forgetHardlink(fi os.FileInfo, path string, seenFiles map[uint64]string) {
+	ino := uint64(fi.Sys().(*syscall.Stat_t).Ino)
+	if seenFiles[ino] == path {
+		delete(seenFiles, ino)
+	}
+}
@@ -4,13 +4,30 @@ package fsutil
 
 import (
 	"os"
+	"syscall"
 
 	"github.com/tonistiigi/fsutil/types"
 )
 
-func loadXattr(_ string, _ *types.Stat) error {
+func loadXattr(_ string, _ *types.Stat, _ *XattrFilter) error {
 	return nil
 }
 
 func setUnixOpt(_ os.FileInfo, _ *types.Stat, _ string, _ map[uint64]string) {
 }
+
+func setExtendedStat(fi os.FileInfo, stat *types.Stat) {
+	if s, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		stat.AccessTime = s.LastAccessTime.Nanoseconds()
+	}
+}
+
+func loadBirthTime(_ string, fi os.FileInfo, stat *types.Stat) error {
+	if s, ok := fi.Sys().(*syscall.Win32FileAttributeData); ok {
+		stat.BirthTime = s.CreationTime.Nanoseconds()
+	}
+	return nil
+}
+
+func forgetHardlink(_ os.FileInfo, _ string, _ map[uint64]string) {
+}
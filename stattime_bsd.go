@@ -0,0 +1,20 @@
+// +build darwin freebsd netbsd
+
+package fsutil
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func setStatTimes(s *syscall.Stat_t, stat *types.Stat) {
+	stat.AccessTime = syscall.TimespecToNsec(s.Atimespec)
+	stat.ChangeTime = syscall.TimespecToNsec(s.Ctimespec)
+}
+
+func loadBirthTime(_ string, fi os.FileInfo, stat *types.Stat) error {
+	stat.BirthTime = syscall.TimespecToNsec(fi.Sys().(*syscall.Stat_t).Birthtimespec)
+	return nil
+}
@@ -0,0 +1,14 @@
+// +build dragonfly linux openbsd solaris
+
+package fsutil
+
+import (
+	"syscall"
+
+	"github.com/tonistiigi/fsutil/types"
+)
+
+func setStatTimes(s *syscall.Stat_t, stat *types.Stat) {
+	stat.AccessTime = syscall.TimespecToNsec(s.Atim)
+	stat.ChangeTime = syscall.TimespecToNsec(s.Ctim)
+}
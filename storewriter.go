@@ -0,0 +1,292 @@
+package fsutil
+
+import (
+	"context"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// Manifest is the tree received by a StoreWriter. Regular files have the
+// digest of their content set in their stat.
+type Manifest struct {
+	Entries []*types.Stat `json:"entries"`
+}
+
+// StoreWriter is a ReceiveTarget that writes the content of regular files
+// to a content-addressable store instead of a directory. Blobs are stored
+// under root/blobs/<algorithm>/<encoded digest>. The received tree is stored
+// as a Manifest blob by Wait.
+//
+// Received data must match the digest sent by the sender. The data of files
+// whose blob is already in the store is not requested, so a sender can add
+// any blob in the store to its manifest by only knowing the digest. A store
+// must only be shared by senders that are allowed to read each other's
+// content.
+type StoreWriter struct {
+	opt  DiskWriterOpt
+	root string
+
+	ctx    context.Context
+	cancel func()
+	eg     *errgroup.Group
+	files  *fileQueue
+
+	mu       sync.Mutex
+	entries  []*types.Stat
+	manifest digest.Digest
+	// ingest are the temporary files created by the writer. Other writers
+	// can use the same store, so only these are removed by RemovePartial.
+	ingest []string
+}
+
+func NewStoreWriter(ctx context.Context, root string, opt DiskWriterOpt) (*StoreWriter, error) {
+	if opt.SyncDataCb == nil && opt.AsyncDataCb == nil {
+		return nil, errors.New("no data callback specified")
+	}
+	if opt.SyncDataCb != nil && opt.AsyncDataCb != nil {
+		return nil, errors.New("can't specify both sync and async data callbacks")
+	}
+	for _, dir := range []string{"ingest", filepath.Join("blobs", string(digest.Canonical))} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	eg, ctx := errgroup.WithContext(ctx)
+
+	return &StoreWriter{
+		opt:    opt,
+		root:   root,
+		ctx:    ctx,
+		cancel: cancel,
+		eg:     eg,
+		files:  newFileQueue(ctx, eg, opt.MaxOpenFiles),
+	}, nil
+}
+
+// Path returns the path of the blob for dgst, so that the store can be used
+// as the ContentStore of a later receive
+func (sw *StoreWriter) Path(ctx context.Context, dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", nil
+	}
+	p := sw.blobPath(dgst)
+	if _, err := os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// Manifest returns the digest of the manifest blob written by Wait
+func (sw *StoreWriter) Manifest() digest.Digest {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.manifest
+}
+
+func (sw *StoreWriter) HandleChange(kind ChangeKind, p string, fi os.FileInfo, err error) (retErr error) {
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-sw.ctx.Done():
+		return sw.ctx.Err()
+	default:
+	}
+
+	defer func() {
+		if retErr != nil {
+			sw.cancel()
+		}
+	}()
+
+	if kind == ChangeKindDelete {
+		sw.mu.Lock()
+		for i, st := range sw.entries {
+			if st.Path == p {
+				sw.entries = append(sw.entries[:i], sw.entries[i+1:]...)
+				break
+			}
+		}
+		sw.mu.Unlock()
+		if sw.opt.NotifyCb != nil {
+			return sw.opt.NotifyCb(kind, p, nil, nil)
+		}
+		return nil
+	}
+
+	stat, ok := fi.Sys().(*types.Stat)
+	if !ok {
+		return errors.WithStack(&os.PathError{Path: p, Err: syscall.EBADMSG, Op: "change without stat info"})
+	}
+
+	statCopy := *stat
+	if sw.opt.NameLookup != nil {
+		mapNames(&statCopy, sw.opt.NameLookup)
+	}
+	if sw.opt.Filter != nil {
+		if ok := sw.opt.Filter(p, &statCopy); !ok {
+			return nil
+		}
+	}
+	statCopy.Xattrs = sw.opt.XattrFilter.Filter(statCopy.Xattrs)
+
+	sw.mu.Lock()
+	sw.entries = append(sw.entries, &statCopy)
+	sw.mu.Unlock()
+
+	if !fi.Mode().IsRegular() || statCopy.Linkname != "" {
+		return processChange(sw.ctx, &sw.opt, kind, p, fi, nil)
+	}
+
+	if statCopy.Digest != "" {
+		dgst, err := digest.Parse(statCopy.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "invalid digest for %s", p)
+		}
+		// the blob has been received before. The sender is trusted to
+		// have the content, see the StoreWriter docs.
+		if blob, err := sw.Path(sw.ctx, dgst); err != nil || blob != "" {
+			if err != nil {
+				return err
+			}
+			return notifyLocal(&sw.opt, kind, p, fi, blob)
+		}
+	}
+
+	if sw.opt.SyncDataCb != nil {
+		return sw.writeBlob(kind, p, fi, &statCopy)
+	}
+	sw.files.Go(func() error {
+		return sw.writeBlob(kind, p, fi, &statCopy)
+	})
+	return nil
+}
+
+// writeBlob requests the data of the regular file st and stores it as a blob
+func (sw *StoreWriter) writeBlob(kind ChangeKind, p string, fi os.FileInfo, st *types.Stat) error {
+	f, err := ioutil.TempFile(filepath.Join(sw.root, "ingest"), "blob-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sw.mu.Lock()
+	sw.ingest = append(sw.ingest, f.Name())
+	sw.mu.Unlock()
+	bw := &blobWriter{sw: sw, f: f, h: digest.Canonical.Hash(), st: st}
+	if err := processChange(sw.ctx, &sw.opt, kind, p, fi, bw); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if !bw.closed {
+		return errors.Errorf("no data received for %s", p)
+	}
+	return nil
+}
+
+func (sw *StoreWriter) blobPath(dgst digest.Digest) string {
+	return filepath.Join(sw.root, "blobs", string(dgst.Algorithm()), dgst.Encoded())
+}
+
+// Wait waits for the data of all files and writes the manifest
+func (sw *StoreWriter) Wait(ctx context.Context) error {
+	if err := sw.eg.Wait(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	digests := map[string]string{}
+	for _, st := range sw.entries {
+		if os.FileMode(st.Mode).IsRegular() {
+			if st.Linkname != "" {
+				st.Digest = digests[st.Linkname]
+			}
+			digests[st.Path] = st.Digest
+		}
+	}
+
+	dt, err := json.Marshal(&Manifest{Entries: sw.entries})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	dgst := digest.FromBytes(dt)
+	if err := ioutil.WriteFile(sw.blobPath(dgst), dt, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	sw.manifest = dgst
+	return nil
+}
+
+// Dir returns an empty string as the files are not written to a directory
+func (sw *StoreWriter) Dir() string {
+	return ""
+}
+
+// RemovePartial removes the incomplete blobs of the writer. The complete
+// ones are kept as they can be reused.
+func (sw *StoreWriter) RemovePartial() error {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	var rerr error
+	for _, p := range sw.ingest {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) && rerr == nil {
+			rerr = errors.Wrapf(err, "failed to remove %s", p)
+		}
+	}
+	sw.ingest = nil
+	return rerr
+}
+
+type blobWriter struct {
+	sw     *StoreWriter
+	f      *os.File
+	h      hash.Hash
+	st     *types.Stat
+	closed bool
+}
+
+func (bw *blobWriter) Write(dt []byte) (int, error) {
+	n, err := bw.f.Write(dt)
+	bw.h.Write(dt[:n])
+	return n, errors.WithStack(err)
+}
+
+// Close moves the blob into place and records its digest in the stat. The
+// data needs to match the digest sent by the sender.
+func (bw *blobWriter) Close() error {
+	bw.closed = true
+	if err := bw.f.Close(); err != nil {
+		os.Remove(bw.f.Name())
+		return errors.WithStack(err)
+	}
+	dgst := digest.NewDigest(digest.Canonical, bw.h)
+	if expected, err := digest.Parse(bw.st.Digest); err == nil && expected.Algorithm() == digest.Canonical && expected != dgst {
+		os.Remove(bw.f.Name())
+		return errors.Errorf("digest mismatch for %s: %s != %s", bw.st.Path, dgst, expected)
+	}
+	bw.st.Digest = dgst.String()
+	if err := os.Rename(bw.f.Name(), bw.sw.blobPath(dgst)); err != nil {
+		os.Remove(bw.f.Name())
+		return errors.WithStack(err)
+	}
+	return nil
+}
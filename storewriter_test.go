@@ -0,0 +1,148 @@
+package fsutil
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestReceiveStoreWriter(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+		"ADD foo file data1",
+		"ADD foo2 file data1",
+		"ADD sub dir",
+		"ADD sub/baz symlink ../foo",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	store, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+
+	receive := func(digester ContentDigester) (digest.Digest, []string) {
+		fs := &openRecorder{FS: NewFS(d, nil)}
+		var sw *StoreWriter
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return SendWithOpt(ctx, s1, fs, SendOpt{ContentDigester: digester})
+		})
+		eg.Go(func() error {
+			return Receive(ctx, s2, "", ReceiveOpt{
+				Target: func(ctx context.Context, _ string, opt DiskWriterOpt) (ReceiveTarget, error) {
+					var err error
+					sw, err = NewStoreWriter(ctx, store, opt)
+					return sw, err
+				},
+			})
+		})
+		require.NoError(t, eg.Wait())
+		sort.Strings(fs.opened)
+		return sw.Manifest(), fs.opened
+	}
+
+	dgst, opened := receive(nil)
+	assert.Equal(t, []string{"bar", "foo", "foo2"}, opened)
+
+	dt, err := ioutil.ReadFile(filepath.Join(store, "blobs/sha256", dgst.Encoded()))
+	require.NoError(t, err)
+	assert.Equal(t, dgst, digest.FromBytes(dt))
+
+	var m Manifest
+	require.NoError(t, json.Unmarshal(dt, &m))
+	entries := map[string]*types.Stat{}
+	var paths []string
+	for _, st := range m.Entries {
+		entries[st.Path] = st
+		paths = append(paths, st.Path)
+	}
+	assert.Equal(t, []string{"bar", "foo", "foo2", "sub", "sub/baz"}, paths)
+	assert.Equal(t, digest.FromString("data1").String(), entries["foo"].Digest)
+	assert.Equal(t, entries["foo"].Digest, entries["foo2"].Digest)
+	assert.Equal(t, "", entries["sub/baz"].Digest)
+	assert.Equal(t, "../foo", entries["sub/baz"].Linkname)
+
+	for p, content := range map[string]string{"bar": "data2", "foo": "data1"} {
+		dt, err := ioutil.ReadFile(filepath.Join(store, "blobs/sha256", digest.Digest(entries[p].Digest).Encoded()))
+		require.NoError(t, err)
+		assert.Equal(t, content, string(dt))
+	}
+	blobs, err := ioutil.ReadDir(filepath.Join(store, "blobs/sha256"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(blobs))
+
+	// blobs that are already in the store are not requested again
+	dgst, opened = receive(FSDigester(NewFS(d, nil)))
+	assert.Equal(t, 0, len(opened))
+
+	dt, err = ioutil.ReadFile(filepath.Join(store, "blobs/sha256", dgst.Encoded()))
+	require.NoError(t, err)
+	var m2 Manifest
+	require.NoError(t, json.Unmarshal(dt, &m2))
+	require.Equal(t, len(m.Entries), len(m2.Entries))
+	for i, st := range m2.Entries {
+		assert.Equal(t, m.Entries[i].Digest, st.Digest, st.Path)
+	}
+}
+
+func TestStoreWriterRemovePartial(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data2",
+		"ADD foo file data1",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	store, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(store)
+
+	// in-flight blob of another receive into the same store
+	require.NoError(t, os.MkdirAll(filepath.Join(store, "ingest"), 0700))
+	other := filepath.Join(store, "ingest", "blob-other")
+	require.NoError(t, ioutil.WriteFile(other, []byte("data"), 0600))
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, &WalkOpt{
+			Map: func(_ string, s *types.Stat) bool {
+				s.Size_ = 0
+				return true
+			},
+		}), nil)
+	})
+	var recvErr error
+	eg.Go(func() error {
+		recvErr = Receive(ctx, s2, "", ReceiveOpt{
+			Limits: &Limits{MaxTotalSize: 8},
+			Target: func(ctx context.Context, _ string, opt DiskWriterOpt) (ReceiveTarget, error) {
+				return NewStoreWriter(ctx, store, opt)
+			},
+		})
+		return recvErr
+	})
+	require.Error(t, eg.Wait())
+	var lerr *LimitError
+	require.True(t, errors.As(recvErr, &lerr), "%v", recvErr)
+
+	fis, err := ioutil.ReadDir(filepath.Join(store, "ingest"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(fis))
+	assert.Equal(t, "blob-other", fis[0].Name())
+}
@@ -10,10 +10,22 @@ import (
 	"syscall"
 
 	"github.com/pkg/errors"
+	"github.com/tonistiigi/fsutil/internal/sparse"
 	"github.com/tonistiigi/fsutil/types"
 )
 
+// TarWriterOpt configures WriteTarWithOpt
+type TarWriterOpt struct {
+	// XattrFilter selects the extended attributes that are written as PAX
+	// records
+	XattrFilter *XattrFilter
+}
+
 func WriteTar(ctx context.Context, fs FS, w io.Writer) error {
+	return WriteTarWithOpt(ctx, fs, w, TarWriterOpt{})
+}
+
+func WriteTarWithOpt(ctx context.Context, fs FS, w io.Writer, opt TarWriterOpt) error {
 	tw := tar.NewWriter(w)
 	err := fs.Walk(ctx, func(path string, fi os.FileInfo, err error) error {
 		if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -36,6 +48,8 @@ func WriteTar(ctx context.Context, fs FS, w io.Writer) error {
 
 		hdr.Uid = int(stat.Uid)
 		hdr.Gid = int(stat.Gid)
+		hdr.Uname = stat.Uname
+		hdr.Gname = stat.Gname
 		hdr.Devmajor = stat.Devmajor
 		hdr.Devminor = stat.Devminor
 		hdr.Linkname = stat.Linkname
@@ -48,22 +62,45 @@ func WriteTar(ctx context.Context, fs FS, w io.Writer) error {
 			}
 		}
 
-		if len(stat.Xattrs) > 0 {
-			hdr.PAXRecords = map[string]string{}
+		hdr.PAXRecords, err = xattrsToPAX(opt.XattrFilter.Filter(stat.Xattrs))
+		if err != nil {
+			return errors.Wrapf(err, "failed to write xattrs of %s", path)
+		}
+
+		var rc io.ReadCloser
+		var extents []sparse.Extent
+		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 && hdr.Linkname == "" {
+			rc, err = fs.Open(path)
+			if err != nil {
+				return err
+			}
+			if f, ok := rc.(*os.File); ok {
+				fi, err := f.Stat()
+				if err != nil {
+					rc.Close()
+					return errors.WithStack(err)
+				}
+				// holes are only used if the file did not change since walking
+				if fi.Size() == hdr.Size {
+					if extents, err = sparse.DataExtents(f, fi); err != nil {
+						rc.Close()
+						return err
+					}
+				}
+			}
 		}
-		for k, v := range stat.Xattrs {
-			hdr.PAXRecords["SCHILY.xattr."+k] = string(v)
+
+		if extents != nil {
+			err := writeSparseFile(w, tw, hdr, rc.(*os.File), extents)
+			rc.Close()
+			return err
 		}
 
 		if err := tw.WriteHeader(hdr); err != nil {
 			return errors.Wrapf(err, "failed to write file header %s", name)
 		}
 
-		if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 && hdr.Linkname == "" {
-			rc, err := fs.Open(path)
-			if err != nil {
-				return err
-			}
+		if rc != nil {
 			if _, err := io.Copy(tw, rc); err != nil {
 				return errors.WithStack(err)
 			}
@@ -38,6 +38,19 @@ type Stat struct {
 	Devmajor int64             `protobuf:"varint,8,opt,name=devmajor,proto3" json:"devmajor,omitempty"`
 	Devminor int64             `protobuf:"varint,9,opt,name=devminor,proto3" json:"devminor,omitempty"`
 	Xattrs   map[string][]byte `protobuf:"bytes,10,rep,name=xattrs,proto3" json:"xattrs,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	// optional fields, zero if unknown. Times are in nanoseconds.
+	AccessTime int64  `protobuf:"varint,11,opt,name=accessTime,proto3" json:"accessTime,omitempty"`
+	ChangeTime int64  `protobuf:"varint,12,opt,name=changeTime,proto3" json:"changeTime,omitempty"`
+	BirthTime  int64  `protobuf:"varint,13,opt,name=birthTime,proto3" json:"birthTime,omitempty"`
+	Ino        uint64 `protobuf:"varint,14,opt,name=ino,proto3" json:"ino,omitempty"`
+	Nlink      uint64 `protobuf:"varint,15,opt,name=nlink,proto3" json:"nlink,omitempty"`
+	// owner names, empty if unknown
+	Uname string `protobuf:"bytes,16,opt,name=uname,proto3" json:"uname,omitempty"`
+	Gname string `protobuf:"bytes,17,opt,name=gname,proto3" json:"gname,omitempty"`
+	// inode flags of FS_IOC_GETFLAGS, Linux only
+	Flags uint32 `protobuf:"varint,18,opt,name=flags,proto3" json:"flags,omitempty"`
+	// content digest of a regular file, set by the sender if requested
+	Digest string `protobuf:"bytes,19,opt,name=digest,proto3" json:"digest,omitempty"`
 }
 
 func (m *Stat) Reset()      { *m = Stat{} }
@@ -142,6 +155,69 @@ func (m *Stat) GetXattrs() map[string][]byte {
 	return nil
 }
 
+func (m *Stat) GetAccessTime() int64 {
+	if m != nil {
+		return m.AccessTime
+	}
+	return 0
+}
+
+func (m *Stat) GetChangeTime() int64 {
+	if m != nil {
+		return m.ChangeTime
+	}
+	return 0
+}
+
+func (m *Stat) GetBirthTime() int64 {
+	if m != nil {
+		return m.BirthTime
+	}
+	return 0
+}
+
+func (m *Stat) GetIno() uint64 {
+	if m != nil {
+		return m.Ino
+	}
+	return 0
+}
+
+func (m *Stat) GetNlink() uint64 {
+	if m != nil {
+		return m.Nlink
+	}
+	return 0
+}
+
+func (m *Stat) GetUname() string {
+	if m != nil {
+		return m.Uname
+	}
+	return ""
+}
+
+func (m *Stat) GetGname() string {
+	if m != nil {
+		return m.Gname
+	}
+	return ""
+}
+
+func (m *Stat) GetFlags() uint32 {
+	if m != nil {
+		return m.Flags
+	}
+	return 0
+}
+
+func (m *Stat) GetDigest() string {
+	if m != nil {
+		return m.Digest
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterType((*Stat)(nil), "fsutil.types.Stat")
 	proto.RegisterMapType((map[string][]byte)(nil), "fsutil.types.Stat.XattrsEntry")
@@ -150,27 +226,33 @@ func init() {
 func init() { proto.RegisterFile("stat.proto", fileDescriptor_01fabdc1b78bd68b) }
 
 var fileDescriptor_01fabdc1b78bd68b = []byte{
-	// 317 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x4c, 0x91, 0xbd, 0x4e, 0xc3, 0x30,
-	0x14, 0x85, 0x73, 0x9b, 0xfe, 0xba, 0x45, 0x42, 0x16, 0x83, 0xd5, 0xe1, 0x2a, 0x62, 0xca, 0x94,
-	0x01, 0x24, 0xc4, 0xcf, 0x86, 0xc4, 0x0b, 0x04, 0x06, 0xc4, 0x66, 0x64, 0x53, 0x4c, 0x9b, 0xb8,
-	0x4a, 0xdc, 0x8a, 0x32, 0xf1, 0x08, 0x3c, 0x06, 0x6f, 0x02, 0x63, 0xc7, 0x8e, 0xd4, 0x5d, 0x18,
-	0xfb, 0x08, 0xc8, 0x4e, 0x5b, 0xba, 0x9d, 0xf3, 0x9d, 0x7b, 0x95, 0x9c, 0x6b, 0x42, 0x4a, 0xc3,
-	0x4d, 0x32, 0x2e, 0xb4, 0xd1, 0xb4, 0xf7, 0x54, 0x4e, 0x8c, 0x1a, 0x25, 0x66, 0x36, 0x96, 0xe5,
-	0xf1, 0x57, 0x8d, 0xd4, 0x6f, 0x0d, 0x37, 0x94, 0x92, 0xfa, 0x98, 0x9b, 0x67, 0x06, 0x11, 0xc4,
-	0x9d, 0xd4, 0x6b, 0xc7, 0x32, 0x2d, 0x24, 0xab, 0x45, 0x10, 0x1f, 0xa4, 0x5e, 0xd3, 0x43, 0x12,
-	0x4e, 0x94, 0x60, 0xa1, 0x47, 0x4e, 0x3a, 0x32, 0x50, 0x82, 0xd5, 0x2b, 0x32, 0x50, 0xc2, 0xed,
-	0x95, 0xea, 0x4d, 0xb2, 0x46, 0x04, 0x71, 0x98, 0x7a, 0x4d, 0x19, 0x69, 0x65, 0x5a, 0xdc, 0xa9,
-	0x4c, 0xb2, 0xa6, 0xc7, 0x5b, 0x4b, 0xfb, 0xa4, 0x3d, 0x52, 0xf9, 0x30, 0xe7, 0x99, 0x64, 0x2d,
-	0xff, 0xf5, 0x9d, 0x77, 0x99, 0x90, 0xd3, 0x8c, 0xbf, 0xe8, 0x82, 0xb5, 0xfd, 0xda, 0xce, 0x6f,
-	0x33, 0x95, 0xeb, 0x82, 0x75, 0xfe, 0x33, 0xe7, 0xe9, 0x19, 0x69, 0xbe, 0x72, 0x63, 0x8a, 0x92,
-	0x91, 0x28, 0x8c, 0xbb, 0x27, 0x98, 0xec, 0xb7, 0x4e, 0x5c, 0xe3, 0xe4, 0xde, 0x0f, 0xdc, 0xe4,
-	0xa6, 0x98, 0xa5, 0x9b, 0xe9, 0xfe, 0x05, 0xe9, 0xee, 0x61, 0x57, 0x6d, 0x28, 0x67, 0x9b, 0x9b,
-	0x38, 0x49, 0x8f, 0x48, 0x63, 0xca, 0x47, 0x93, 0xea, 0x26, 0xbd, 0xb4, 0x32, 0x97, 0xb5, 0x73,
-	0xb8, 0xbe, 0x9a, 0x2f, 0x31, 0x58, 0x2c, 0x31, 0x58, 0x2f, 0x11, 0xde, 0x2d, 0xc2, 0xa7, 0x45,
-	0xf8, 0xb6, 0x08, 0x73, 0x8b, 0xf0, 0x63, 0x11, 0x7e, 0x2d, 0x06, 0x6b, 0x8b, 0xf0, 0xb1, 0xc2,
-	0x60, 0xbe, 0xc2, 0x60, 0xb1, 0xc2, 0xe0, 0xa1, 0xe1, 0x7f, 0xe8, 0xb1, 0xe9, 0xdf, 0xe6, 0xf4,
-	0x2f, 0x00, 0x00, 0xff, 0xff, 0x06, 0x97, 0xf3, 0xd7, 0xa9, 0x01, 0x00, 0x00,
+	// 412 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x4c, 0x92, 0xbd, 0xae, 0xd3, 0x30,
+	0x1c, 0xc5, 0xe3, 0x9b, 0x34, 0xf7, 0xd6, 0xed, 0x85, 0x62, 0x10, 0xb2, 0x2a, 0x64, 0x45, 0x4c,
+	0x99, 0x32, 0x80, 0x84, 0xf8, 0xd8, 0x90, 0x78, 0x81, 0xc0, 0x80, 0xd8, 0xdc, 0xc6, 0x4d, 0x4d,
+	0xf3, 0x51, 0xc5, 0x4e, 0x45, 0x99, 0x78, 0x04, 0xde, 0x02, 0x1e, 0x85, 0xb1, 0x63, 0x47, 0x9a,
+	0x2e, 0x8c, 0x7d, 0x04, 0xf4, 0xff, 0xbb, 0x5f, 0xdb, 0x39, 0xbf, 0x63, 0x3b, 0xfe, 0x1f, 0x87,
+	0x52, 0x63, 0xa5, 0x4d, 0x96, 0x4d, 0x6d, 0x6b, 0x36, 0x9c, 0x99, 0xd6, 0xea, 0x22, 0xb1, 0xeb,
+	0xa5, 0x32, 0xcf, 0x7f, 0x05, 0x34, 0xf8, 0x68, 0xa5, 0x65, 0x8c, 0x06, 0x4b, 0x69, 0xe7, 0x9c,
+	0x44, 0x24, 0xee, 0xa7, 0xa8, 0x81, 0x95, 0x75, 0xa6, 0xf8, 0x4d, 0x44, 0xe2, 0xfb, 0x14, 0x35,
+	0x1b, 0x51, 0xbf, 0xd5, 0x19, 0xf7, 0x11, 0x81, 0x04, 0x92, 0xeb, 0x8c, 0x07, 0x8e, 0xe4, 0x3a,
+	0x83, 0x7d, 0x46, 0x7f, 0x57, 0xbc, 0x17, 0x91, 0xd8, 0x4f, 0x51, 0x33, 0x4e, 0x6f, 0xcb, 0x3a,
+	0xfb, 0xa4, 0x4b, 0xc5, 0x43, 0xc4, 0x27, 0xcb, 0xc6, 0xf4, 0xae, 0xd0, 0xd5, 0xa2, 0x92, 0xa5,
+	0xe2, 0xb7, 0xf8, 0xf5, 0xb3, 0x87, 0x2c, 0x53, 0xab, 0x52, 0x7e, 0xad, 0x1b, 0x7e, 0x87, 0xdb,
+	0xce, 0xfe, 0x94, 0xe9, 0xaa, 0x6e, 0x78, 0xff, 0x92, 0x81, 0x67, 0xaf, 0x68, 0xf8, 0x4d, 0x5a,
+	0xdb, 0x18, 0x4e, 0x23, 0x3f, 0x1e, 0xbc, 0x10, 0xc9, 0xf5, 0xd4, 0x09, 0x4c, 0x9c, 0x7c, 0xc6,
+	0x05, 0x1f, 0x2a, 0xdb, 0xac, 0xd3, 0xe3, 0x6a, 0x26, 0x28, 0x95, 0xd3, 0xa9, 0x32, 0x06, 0x2f,
+	0x3a, 0xc0, 0x53, 0xaf, 0x08, 0xe4, 0xd3, 0xb9, 0xac, 0x72, 0x85, 0xf9, 0xd0, 0xe5, 0x17, 0xc2,
+	0x9e, 0xd1, 0xfe, 0x44, 0x37, 0x76, 0x8e, 0xf1, 0x3d, 0xc6, 0x17, 0x00, 0x4d, 0xe9, 0xaa, 0xe6,
+	0x0f, 0x22, 0x12, 0x07, 0x29, 0x48, 0xf6, 0x84, 0xf6, 0x2a, 0x18, 0x96, 0x3f, 0x44, 0xe6, 0x0c,
+	0xd0, 0x16, 0xeb, 0x18, 0x61, 0x1d, 0xce, 0x00, 0xcd, 0x91, 0x3e, 0x72, 0x34, 0x3f, 0xd1, 0x59,
+	0x21, 0x73, 0xc3, 0x19, 0xf6, 0xef, 0x0c, 0x7b, 0x4a, 0xc3, 0x4c, 0xe7, 0xca, 0x58, 0xfe, 0x18,
+	0x17, 0x1f, 0xdd, 0xf8, 0x0d, 0x1d, 0x5c, 0x8d, 0x0d, 0x17, 0x5a, 0xa8, 0xf5, 0xf1, 0xcd, 0x41,
+	0xc2, 0x71, 0x2b, 0x59, 0xb4, 0xee, 0xcd, 0x87, 0xa9, 0x33, 0x6f, 0x6f, 0x5e, 0x93, 0xf7, 0xef,
+	0x36, 0x3b, 0xe1, 0x6d, 0x77, 0xc2, 0x3b, 0xec, 0x04, 0xf9, 0xd1, 0x09, 0xf2, 0xbb, 0x13, 0xe4,
+	0x4f, 0x27, 0xc8, 0xa6, 0x13, 0xe4, 0x6f, 0x27, 0xc8, 0xbf, 0x4e, 0x78, 0x87, 0x4e, 0x90, 0x9f,
+	0x7b, 0xe1, 0x6d, 0xf6, 0xc2, 0xdb, 0xee, 0x85, 0xf7, 0xa5, 0x87, 0x85, 0x4f, 0x42, 0xfc, 0xf7,
+	0x5e, 0xfe, 0x1f, 0x00, 0xa7, 0x12, 0x91, 0x09, 0x89, 0x02, 0x00, 0x00,
 }
 
 func (this *Stat) Equal(that interface{}) bool {
@@ -227,13 +309,40 @@ func (this *Stat) Equal(that interface{}) bool {
 			return false
 		}
 	}
+	if this.AccessTime != that1.AccessTime {
+		return false
+	}
+	if this.ChangeTime != that1.ChangeTime {
+		return false
+	}
+	if this.BirthTime != that1.BirthTime {
+		return false
+	}
+	if this.Ino != that1.Ino {
+		return false
+	}
+	if this.Nlink != that1.Nlink {
+		return false
+	}
+	if this.Uname != that1.Uname {
+		return false
+	}
+	if this.Gname != that1.Gname {
+		return false
+	}
+	if this.Flags != that1.Flags {
+		return false
+	}
+	if this.Digest != that1.Digest {
+		return false
+	}
 	return true
 }
 func (this *Stat) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 14)
+	s := make([]string, 0, 23)
 	s = append(s, "&types.Stat{")
 	s = append(s, "Path: "+fmt.Sprintf("%#v", this.Path)+",\n")
 	s = append(s, "Mode: "+fmt.Sprintf("%#v", this.Mode)+",\n")
@@ -257,6 +366,15 @@ func (this *Stat) GoString() string {
 	if this.Xattrs != nil {
 		s = append(s, "Xattrs: "+mapStringForXattrs+",\n")
 	}
+	s = append(s, "AccessTime: "+fmt.Sprintf("%#v", this.AccessTime)+",\n")
+	s = append(s, "ChangeTime: "+fmt.Sprintf("%#v", this.ChangeTime)+",\n")
+	s = append(s, "BirthTime: "+fmt.Sprintf("%#v", this.BirthTime)+",\n")
+	s = append(s, "Ino: "+fmt.Sprintf("%#v", this.Ino)+",\n")
+	s = append(s, "Nlink: "+fmt.Sprintf("%#v", this.Nlink)+",\n")
+	s = append(s, "Uname: "+fmt.Sprintf("%#v", this.Uname)+",\n")
+	s = append(s, "Gname: "+fmt.Sprintf("%#v", this.Gname)+",\n")
+	s = append(s, "Flags: "+fmt.Sprintf("%#v", this.Flags)+",\n")
+	s = append(s, "Digest: "+fmt.Sprintf("%#v", this.Digest)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -288,6 +406,65 @@ func (m *Stat) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.Digest) > 0 {
+		i -= len(m.Digest)
+		copy(dAtA[i:], m.Digest)
+		i = encodeVarintStat(dAtA, i, uint64(len(m.Digest)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x9a
+	}
+	if m.Flags != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Flags))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x90
+	}
+	if len(m.Gname) > 0 {
+		i -= len(m.Gname)
+		copy(dAtA[i:], m.Gname)
+		i = encodeVarintStat(dAtA, i, uint64(len(m.Gname)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x8a
+	}
+	if len(m.Uname) > 0 {
+		i -= len(m.Uname)
+		copy(dAtA[i:], m.Uname)
+		i = encodeVarintStat(dAtA, i, uint64(len(m.Uname)))
+		i--
+		dAtA[i] = 0x1
+		i--
+		dAtA[i] = 0x82
+	}
+	if m.Nlink != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Nlink))
+		i--
+		dAtA[i] = 0x78
+	}
+	if m.Ino != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.Ino))
+		i--
+		dAtA[i] = 0x70
+	}
+	if m.BirthTime != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.BirthTime))
+		i--
+		dAtA[i] = 0x68
+	}
+	if m.ChangeTime != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.ChangeTime))
+		i--
+		dAtA[i] = 0x60
+	}
+	if m.AccessTime != 0 {
+		i = encodeVarintStat(dAtA, i, uint64(m.AccessTime))
+		i--
+		dAtA[i] = 0x58
+	}
 	if len(m.Xattrs) > 0 {
 		for k := range m.Xattrs {
 			v := m.Xattrs[k]
@@ -419,6 +596,36 @@ func (m *Stat) Size() (n int) {
 			n += mapEntrySize + 1 + sovStat(uint64(mapEntrySize))
 		}
 	}
+	if m.AccessTime != 0 {
+		n += 1 + sovStat(uint64(m.AccessTime))
+	}
+	if m.ChangeTime != 0 {
+		n += 1 + sovStat(uint64(m.ChangeTime))
+	}
+	if m.BirthTime != 0 {
+		n += 1 + sovStat(uint64(m.BirthTime))
+	}
+	if m.Ino != 0 {
+		n += 1 + sovStat(uint64(m.Ino))
+	}
+	if m.Nlink != 0 {
+		n += 1 + sovStat(uint64(m.Nlink))
+	}
+	l = len(m.Uname)
+	if l > 0 {
+		n += 2 + l + sovStat(uint64(l))
+	}
+	l = len(m.Gname)
+	if l > 0 {
+		n += 2 + l + sovStat(uint64(l))
+	}
+	if m.Flags != 0 {
+		n += 2 + sovStat(uint64(m.Flags))
+	}
+	l = len(m.Digest)
+	if l > 0 {
+		n += 2 + l + sovStat(uint64(l))
+	}
 	return n
 }
 
@@ -453,6 +660,15 @@ func (this *Stat) String() string {
 		`Devmajor:` + fmt.Sprintf("%v", this.Devmajor) + `,`,
 		`Devminor:` + fmt.Sprintf("%v", this.Devminor) + `,`,
 		`Xattrs:` + mapStringForXattrs + `,`,
+		`AccessTime:` + fmt.Sprintf("%v", this.AccessTime) + `,`,
+		`ChangeTime:` + fmt.Sprintf("%v", this.ChangeTime) + `,`,
+		`BirthTime:` + fmt.Sprintf("%v", this.BirthTime) + `,`,
+		`Ino:` + fmt.Sprintf("%v", this.Ino) + `,`,
+		`Nlink:` + fmt.Sprintf("%v", this.Nlink) + `,`,
+		`Uname:` + fmt.Sprintf("%v", this.Uname) + `,`,
+		`Gname:` + fmt.Sprintf("%v", this.Gname) + `,`,
+		`Flags:` + fmt.Sprintf("%v", this.Flags) + `,`,
+		`Digest:` + fmt.Sprintf("%v", this.Digest) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -819,6 +1035,216 @@ func (m *Stat) Unmarshal(dAtA []byte) error {
 			}
 			m.Xattrs[mapkey] = mapvalue
 			iNdEx = postIndex
+		case 11:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field AccessTime", wireType)
+			}
+			m.AccessTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.AccessTime |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 12:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChangeTime", wireType)
+			}
+			m.ChangeTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.ChangeTime |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 13:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field BirthTime", wireType)
+			}
+			m.BirthTime = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.BirthTime |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 14:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Ino", wireType)
+			}
+			m.Ino = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Ino |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 15:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Nlink", wireType)
+			}
+			m.Nlink = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Nlink |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 16:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Uname", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStat
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStat
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Uname = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 17:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Gname", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStat
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStat
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Gname = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
+		case 18:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Flags", wireType)
+			}
+			m.Flags = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Flags |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 19:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Digest", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStat
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStat
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthStat
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Digest = string(dAtA[iNdEx:postIndex])
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStat(dAtA[iNdEx:])
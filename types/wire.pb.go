@@ -34,6 +34,7 @@ const (
 	PACKET_DATA Packet_PacketType = 2
 	PACKET_FIN  Packet_PacketType = 3
 	PACKET_ERR  Packet_PacketType = 4
+	PACKET_HOLE Packet_PacketType = 5
 )
 
 var Packet_PacketType_name = map[int32]string{
@@ -42,6 +43,7 @@ var Packet_PacketType_name = map[int32]string{
 	2: "PACKET_DATA",
 	3: "PACKET_FIN",
 	4: "PACKET_ERR",
+	5: "PACKET_HOLE",
 }
 
 var Packet_PacketType_value = map[string]int32{
@@ -50,6 +52,7 @@ var Packet_PacketType_value = map[string]int32{
 	"PACKET_DATA": 2,
 	"PACKET_FIN":  3,
 	"PACKET_ERR":  4,
+	"PACKET_HOLE": 5,
 }
 
 func (Packet_PacketType) EnumDescriptor() ([]byte, []int) {
@@ -61,6 +64,10 @@ type Packet struct {
 	Stat *Stat             `protobuf:"bytes,2,opt,name=stat,proto3" json:"stat,omitempty"`
 	ID   uint32            `protobuf:"varint,3,opt,name=ID,proto3" json:"ID,omitempty"`
 	Data []byte            `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+	// size of the hole in a PACKET_HOLE
+	Size_ int64 `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
+	// set in PACKET_REQ if the receiver accepts PACKET_HOLE
+	Sparse bool `protobuf:"varint,6,opt,name=sparse,proto3" json:"sparse,omitempty"`
 }
 
 func (m *Packet) Reset()      { *m = Packet{} }
@@ -123,6 +130,20 @@ func (m *Packet) GetData() []byte {
 	return nil
 }
 
+func (m *Packet) GetSize_() int64 {
+	if m != nil {
+		return m.Size_
+	}
+	return 0
+}
+
+func (m *Packet) GetSparse() bool {
+	if m != nil {
+		return m.Sparse
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterEnum("fsutil.types.Packet_PacketType", Packet_PacketType_name, Packet_PacketType_value)
 	proto.RegisterType((*Packet)(nil), "fsutil.types.Packet")
@@ -131,25 +152,27 @@ func init() {
 func init() { proto.RegisterFile("wire.proto", fileDescriptor_f2dcdddcdf68d8e0) }
 
 var fileDescriptor_f2dcdddcdf68d8e0 = []byte{
-	// 276 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2a, 0xcf, 0x2c, 0x4a,
-	0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x49, 0x2b, 0x2e, 0x2d, 0xc9, 0xcc, 0xd1, 0x2b,
-	0xa9, 0x2c, 0x48, 0x2d, 0x96, 0xe2, 0x2a, 0x2e, 0x49, 0x2c, 0x81, 0xc8, 0x28, 0xbd, 0x64, 0xe4,
-	0x62, 0x0b, 0x48, 0x4c, 0xce, 0x4e, 0x2d, 0x11, 0x32, 0xe6, 0x62, 0x01, 0xc9, 0x4b, 0x30, 0x2a,
-	0x30, 0x6a, 0xf0, 0x19, 0xc9, 0xeb, 0x21, 0xeb, 0xd1, 0x83, 0xa8, 0x81, 0x52, 0x21, 0x95, 0x05,
-	0xa9, 0x41, 0x60, 0xc5, 0x42, 0x6a, 0x5c, 0x2c, 0x20, 0xd3, 0x24, 0x98, 0x14, 0x18, 0x35, 0xb8,
-	0x8d, 0x84, 0x50, 0x35, 0x05, 0x97, 0x24, 0x96, 0x04, 0x81, 0xe5, 0x85, 0xf8, 0xb8, 0x98, 0x3c,
-	0x5d, 0x24, 0x98, 0x15, 0x18, 0x35, 0x78, 0x83, 0x98, 0x3c, 0x5d, 0x84, 0x84, 0xb8, 0x58, 0x52,
-	0x12, 0x4b, 0x12, 0x25, 0x58, 0x14, 0x18, 0x35, 0x78, 0x82, 0xc0, 0x6c, 0xa5, 0x38, 0x2e, 0x2e,
-	0x84, 0xf9, 0x42, 0xfc, 0x5c, 0xdc, 0x01, 0x8e, 0xce, 0xde, 0xae, 0x21, 0xf1, 0xc1, 0x21, 0x8e,
-	0x21, 0x02, 0x0c, 0x42, 0x7c, 0x5c, 0x5c, 0x50, 0x81, 0x20, 0xd7, 0x40, 0x01, 0x46, 0x24, 0x05,
-	0x2e, 0x8e, 0x21, 0x8e, 0x02, 0x4c, 0x48, 0x0a, 0xdc, 0x3c, 0xfd, 0x04, 0x98, 0x91, 0xf8, 0xae,
-	0x41, 0x41, 0x02, 0x2c, 0x4e, 0xd6, 0x17, 0x1e, 0xca, 0x31, 0xdc, 0x78, 0x28, 0xc7, 0xf0, 0xe1,
-	0xa1, 0x1c, 0x63, 0xc3, 0x23, 0x39, 0xc6, 0x15, 0x8f, 0xe4, 0x18, 0x4f, 0x3c, 0x92, 0x63, 0xbc,
-	0xf0, 0x48, 0x8e, 0xf1, 0xc1, 0x23, 0x39, 0xc6, 0x17, 0x8f, 0xe4, 0x18, 0x3e, 0x3c, 0x92, 0x63,
-	0x9c, 0xf0, 0x58, 0x8e, 0xe1, 0xc2, 0x63, 0x39, 0x86, 0x1b, 0x8f, 0xe5, 0x18, 0xa2, 0x58, 0xc1,
-	0x7e, 0x49, 0x62, 0x03, 0x87, 0x97, 0x31, 0x20, 0x00, 0x00, 0xff, 0xff, 0x3f, 0x9d, 0xe3, 0x51,
-	0x57, 0x01, 0x00, 0x00,
+	// 310 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x54, 0x90, 0x31, 0x4b, 0xc3, 0x40,
+	0x14, 0xc7, 0xef, 0xa5, 0x69, 0x90, 0xd7, 0x5a, 0xc3, 0x0d, 0x12, 0x1c, 0x9e, 0xa1, 0x83, 0x64,
+	0xca, 0xd0, 0x8e, 0x4e, 0xd1, 0x46, 0x2c, 0x8a, 0xd6, 0x6b, 0x26, 0x17, 0x89, 0x7a, 0x42, 0x51,
+	0x68, 0xe8, 0x9d, 0x48, 0x9d, 0xfc, 0x08, 0x7e, 0x0a, 0xf1, 0xa3, 0x38, 0x76, 0xec, 0x68, 0xaf,
+	0x8b, 0x63, 0x3f, 0x82, 0xf4, 0x1a, 0x30, 0x4e, 0xf7, 0xde, 0xff, 0xff, 0xfb, 0x1f, 0x8f, 0x3f,
+	0xe2, 0xcb, 0x68, 0x22, 0xe3, 0x62, 0x32, 0xd6, 0x63, 0xde, 0x7c, 0x50, 0xcf, 0x7a, 0xf4, 0x14,
+	0xeb, 0x69, 0x21, 0xd5, 0x1e, 0x2a, 0x9d, 0xeb, 0x8d, 0xd3, 0xfe, 0x70, 0xd0, 0x1b, 0xe4, 0x77,
+	0x8f, 0x52, 0xf3, 0x2e, 0xba, 0x6b, 0x3f, 0x80, 0x10, 0xa2, 0x56, 0x67, 0x3f, 0xae, 0x66, 0xe2,
+	0x0d, 0x53, 0x3e, 0xd9, 0xb4, 0x90, 0xc2, 0xc2, 0xfc, 0x00, 0xdd, 0xf5, 0x6f, 0x81, 0x13, 0x42,
+	0xd4, 0xe8, 0xf0, 0xff, 0xa1, 0xa1, 0xce, 0xb5, 0xb0, 0x3e, 0x6f, 0xa1, 0xd3, 0xef, 0x05, 0xb5,
+	0x10, 0xa2, 0x6d, 0xe1, 0xf4, 0x7b, 0x9c, 0xa3, 0x7b, 0x9f, 0xeb, 0x3c, 0x70, 0x43, 0x88, 0x9a,
+	0xc2, 0xce, 0x6b, 0x4d, 0x8d, 0x5e, 0x65, 0x50, 0x0f, 0x21, 0xaa, 0x09, 0x3b, 0xf3, 0x5d, 0xf4,
+	0x54, 0x91, 0x4f, 0x94, 0x0c, 0xbc, 0x10, 0xa2, 0x2d, 0x51, 0x6e, 0xed, 0x31, 0xe2, 0xdf, 0x2d,
+	0x7c, 0x07, 0x1b, 0x83, 0xe4, 0xf8, 0x2c, 0xcd, 0x6e, 0x86, 0x59, 0x92, 0xf9, 0x8c, 0xb7, 0x10,
+	0x4b, 0x41, 0xa4, 0x57, 0x3e, 0x54, 0x80, 0x5e, 0x92, 0x25, 0xbe, 0x53, 0x01, 0x4e, 0xfa, 0x17,
+	0x7e, 0xad, 0xb2, 0xa7, 0x42, 0xf8, 0x6e, 0x25, 0x70, 0x7a, 0x79, 0x9e, 0xfa, 0xf5, 0xa3, 0xc3,
+	0xd9, 0x82, 0xd8, 0x7c, 0x41, 0x6c, 0xb5, 0x20, 0x78, 0x33, 0x04, 0x9f, 0x86, 0xe0, 0xcb, 0x10,
+	0xcc, 0x0c, 0xc1, 0xb7, 0x21, 0xf8, 0x31, 0xc4, 0x56, 0x86, 0xe0, 0x7d, 0x49, 0x6c, 0xb6, 0x24,
+	0x36, 0x5f, 0x12, 0xbb, 0xae, 0xdb, 0x22, 0x6e, 0x3d, 0x5b, 0x76, 0xf7, 0x77, 0x00, 0x48, 0xaa,
+	0xa2, 0x5f, 0x94, 0x01, 0x00, 0x00,
 }
 
 func (x Packet_PacketType) String() string {
@@ -190,13 +213,19 @@ func (this *Packet) Equal(that interface{}) bool {
 	if !bytes.Equal(this.Data, that1.Data) {
 		return false
 	}
+	if this.Size_ != that1.Size_ {
+		return false
+	}
+	if this.Sparse != that1.Sparse {
+		return false
+	}
 	return true
 }
 func (this *Packet) GoString() string {
 	if this == nil {
 		return "nil"
 	}
-	s := make([]string, 0, 8)
+	s := make([]string, 0, 10)
 	s = append(s, "&types.Packet{")
 	s = append(s, "Type: "+fmt.Sprintf("%#v", this.Type)+",\n")
 	if this.Stat != nil {
@@ -204,6 +233,8 @@ func (this *Packet) GoString() string {
 	}
 	s = append(s, "ID: "+fmt.Sprintf("%#v", this.ID)+",\n")
 	s = append(s, "Data: "+fmt.Sprintf("%#v", this.Data)+",\n")
+	s = append(s, "Size_: "+fmt.Sprintf("%#v", this.Size_)+",\n")
+	s = append(s, "Sparse: "+fmt.Sprintf("%#v", this.Sparse)+",\n")
 	s = append(s, "}")
 	return strings.Join(s, "")
 }
@@ -235,6 +266,21 @@ func (m *Packet) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Sparse {
+		i--
+		if m.Sparse {
+			dAtA[i] = 1
+		} else {
+			dAtA[i] = 0
+		}
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.Size_ != 0 {
+		i = encodeVarintWire(dAtA, i, uint64(m.Size_))
+		i--
+		dAtA[i] = 0x28
+	}
 	if len(m.Data) > 0 {
 		i -= len(m.Data)
 		copy(dAtA[i:], m.Data)
@@ -298,6 +344,12 @@ func (m *Packet) Size() (n int) {
 	if l > 0 {
 		n += 1 + l + sovWire(uint64(l))
 	}
+	if m.Size_ != 0 {
+		n += 1 + sovWire(uint64(m.Size_))
+	}
+	if m.Sparse {
+		n += 2
+	}
 	return n
 }
 
@@ -316,6 +368,8 @@ func (this *Packet) String() string {
 		`Stat:` + strings.Replace(fmt.Sprintf("%v", this.Stat), "Stat", "Stat", 1) + `,`,
 		`ID:` + fmt.Sprintf("%v", this.ID) + `,`,
 		`Data:` + fmt.Sprintf("%v", this.Data) + `,`,
+		`Size_:` + fmt.Sprintf("%v", this.Size_) + `,`,
+		`Sparse:` + fmt.Sprintf("%v", this.Sparse) + `,`,
 		`}`,
 	}, "")
 	return s
@@ -465,6 +519,45 @@ func (m *Packet) Unmarshal(dAtA []byte) error {
 				m.Data = []byte{}
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Size_", wireType)
+			}
+			m.Size_ = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowWire
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Size_ |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Sparse", wireType)
+			}
+			var v int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowWire
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				v |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			m.Sparse = bool(v != 0)
 		default:
 			iNdEx = preIndex
 			skippy, err := skipWire(dAtA[iNdEx:])
@@ -8,7 +8,6 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/docker/docker/pkg/fileutils"
 	"github.com/pkg/errors"
 	"github.com/tonistiigi/fsutil/types"
 )
@@ -19,7 +18,29 @@ type WalkOpt struct {
 	// FollowPaths contains symlinks that are resolved into include patterns
 	// before performing the fs walk
 	FollowPaths []string
+	// IgnoreFiles contains file names (e.g. ".gitignore") that are looked
+	// up in every directory during the walk. Their rules are applied with
+	// gitignore semantics to the subtree of the directory containing them.
+	IgnoreFiles []string
 	Map         FilterFunc
+	// Trace is called with the filtering decision for every path that is
+	// considered by the walk
+	Trace TraceFunc
+	// Limits restricts the entries and data that are walked
+	Limits *Limits
+	// XattrFilter selects the extended attributes that are loaded
+	XattrFilter *XattrFilter
+	// BirthTime loads the birth time of the files. On Linux this needs an
+	// additional statx call for every file.
+	BirthTime bool
+	// ExtendedStat loads the access and change times, the inode number and
+	// the link count of the files. They change without the content of the
+	// files changing, so they are not loaded by default.
+	ExtendedStat bool
+	// NameLookup sets the user and group names of the files
+	NameLookup NameLookup
+	// InodeFlags loads the inode flags of regular files and directories
+	InodeFlags bool
 }
 
 func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) error {
@@ -35,33 +56,39 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 		return errors.WithStack(&os.PathError{Op: "walk", Path: root, Err: syscall.ENOTDIR})
 	}
 
-	var pm *fileutils.PatternMatcher
-	if opt != nil && opt.ExcludePatterns != nil {
-		pm, err = fileutils.NewPatternMatcher(opt.ExcludePatterns)
+	var pf *PathFilter
+	if opt != nil {
+		pf, err = NewPathFilter(opt.IncludePatterns, opt.ExcludePatterns)
 		if err != nil {
-			return errors.Wrapf(err, "invalid excludepatterns: %s", opt.ExcludePatterns)
+			return err
 		}
-	}
-
-	var includePatterns []string
-	if opt != nil && opt.IncludePatterns != nil {
-		includePatterns = make([]string, len(opt.IncludePatterns))
-		for k := range opt.IncludePatterns {
-			includePatterns[k] = filepath.Clean(opt.IncludePatterns[k])
+		if pf.pm != nil && opt.Trace != nil {
+			pf.et, err = newExcludeTracer(pf.pm)
+			if err != nil {
+				return errors.Wrapf(err, "invalid excludepatterns: %s", opt.ExcludePatterns)
+			}
 		}
-	}
-	if opt != nil && opt.FollowPaths != nil {
-		targets, err := FollowLinks(p, opt.FollowPaths)
-		if err != nil {
-			return err
+		if len(opt.IgnoreFiles) > 0 {
+			pf.im = newIgnoreMatcher(root, opt.IgnoreFiles)
 		}
-		if targets != nil {
-			includePatterns = append(includePatterns, targets...)
-			includePatterns = dedupePaths(includePatterns)
+		if opt.FollowPaths != nil {
+			targets, err := FollowLinks(p, opt.FollowPaths)
+			if err != nil {
+				return err
+			}
+			if targets != nil {
+				for _, t := range targets {
+					pf.includePatterns = append(pf.includePatterns, newIncludePattern(t))
+				}
+				pf.includePatterns = dedupeIncludePatterns(pf.includePatterns)
+			}
 		}
 	}
 
-	var lastIncludedDir string
+	var lim *limiter
+	if opt != nil {
+		lim = newLimiter(opt.Limits)
+	}
 
 	seenFiles := make(map[uint64]string)
 	return filepath.Walk(root, func(path string, fi os.FileInfo, err error) (retErr error) {
@@ -84,68 +111,18 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 			return nil
 		}
 
-		if opt != nil {
-			if includePatterns != nil {
-				skip := false
-				if lastIncludedDir != "" {
-					if strings.HasPrefix(path, lastIncludedDir+string(filepath.Separator)) {
-						skip = true
-					}
-				}
-
-				if !skip {
-					matched := false
-					partial := true
-					for _, p := range includePatterns {
-						if ok, p := matchPrefix(p, path); ok {
-							matched = true
-							if !p {
-								partial = false
-								break
-							}
-						}
-					}
-					if !matched {
-						if fi.IsDir() {
-							return filepath.SkipDir
-						}
-						return nil
-					}
-					if !partial && fi.IsDir() {
-						lastIncludedDir = path
-					}
-				}
+		tr := FilterTrace{Path: filepath.ToSlash(path)}
+		if pf != nil {
+			ok, err := pf.match(path, fi.IsDir(), &tr)
+			if err != nil {
+				return err
 			}
-			if pm != nil {
-				m, err := pm.Matches(path)
-				if err != nil {
-					return errors.Wrap(err, "failed to match excludepatterns")
-				}
-
-				if m {
-					if fi.IsDir() {
-						if !pm.Exclusions() {
-							return filepath.SkipDir
-						}
-						dirSlash := path + string(filepath.Separator)
-						for _, pat := range pm.Patterns() {
-							if !pat.Exclusion() {
-								continue
-							}
-							patStr := pat.String() + string(filepath.Separator)
-							if strings.HasPrefix(patStr, dirSlash) {
-								goto passedFilter
-							}
-						}
-						return filepath.SkipDir
-					}
-					return nil
-				}
+			if !ok {
+				return skipPath(opt, &tr, fi)
 			}
 		}
 
-	passedFilter:
-		stat, err := mkstat(origpath, path, fi, seenFiles)
+		stat, err := mkstat(origpath, path, fi, seenFiles, opt)
 		if err != nil {
 			return err
 		}
@@ -156,9 +133,26 @@ func Walk(ctx context.Context, p string, opt *WalkOpt, fn filepath.WalkFunc) err
 		default:
 			if opt != nil && opt.Map != nil {
 				if allowed := opt.Map(stat.Path, stat); !allowed {
+					forgetHardlink(fi, stat.Path, seenFiles)
+					tr.set(FilterRuleMap, "", "")
+					tr.Decision = FilterExcluded
+					if opt.Trace != nil {
+						opt.Trace(tr)
+					}
 					return nil
 				}
 			}
+			if skip, err := lim.check(stat); err != nil {
+				return err
+			} else if skip {
+				forgetHardlink(fi, stat.Path, seenFiles)
+				tr.set(FilterRuleLimit, "", "")
+				return skipPath(opt, &tr, fi)
+			}
+			if opt != nil && opt.Trace != nil {
+				tr.Decision = FilterIncluded
+				opt.Trace(tr)
+			}
 			if err := fn(stat.Path, &StatInfo{stat}, nil); err != nil {
 				return err
 			}
@@ -183,6 +177,22 @@ func (s *StatInfo) Mode() os.FileMode {
 func (s *StatInfo) ModTime() time.Time {
 	return time.Unix(s.Stat.ModTime/1e9, s.Stat.ModTime%1e9)
 }
+
+// AccessTime returns the access time or zero time if it is unknown
+func (s *StatInfo) AccessTime() time.Time {
+	return nsecToTime(s.Stat.AccessTime)
+}
+
+// ChangeTime returns the inode change time or zero time if it is unknown
+func (s *StatInfo) ChangeTime() time.Time {
+	return nsecToTime(s.Stat.ChangeTime)
+}
+
+// BirthTime returns the creation time or zero time if it is unknown
+func (s *StatInfo) BirthTime() time.Time {
+	return nsecToTime(s.Stat.BirthTime)
+}
+
 func (s *StatInfo) IsDir() bool {
 	return s.Mode().IsDir()
 }
@@ -190,30 +200,139 @@ func (s *StatInfo) Sys() interface{} {
 	return s.Stat
 }
 
-func matchPrefix(pattern, name string) (bool, bool) {
-	count := strings.Count(name, string(filepath.Separator))
-	partial := false
-	if strings.Count(pattern, string(filepath.Separator)) > count {
-		pattern = trimUntilIndex(pattern, string(filepath.Separator), count)
-		partial = true
+func nsecToTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// includePattern is a parsed IncludePatterns entry. Patterns are matched
+// per path component, "**" matches any number of components and a leading
+// "!" turns the pattern into an exception for the preceding patterns.
+type includePattern struct {
+	str    string
+	parts  []string
+	negate bool
+}
+
+func newIncludePattern(p string) *includePattern {
+	ip := &includePattern{}
+	if strings.HasPrefix(p, "!") {
+		ip.negate = true
+		p = p[1:]
+	}
+	ip.str = filepath.Clean(p)
+	if ip.str != "." {
+		for _, part := range strings.Split(ip.str, string(filepath.Separator)) {
+			// consecutive "**" components are equivalent to one
+			if part == "**" && len(ip.parts) > 0 && ip.parts[len(ip.parts)-1] == "**" {
+				continue
+			}
+			ip.parts = append(ip.parts, part)
+		}
+	}
+	return ip
+}
+
+func (ip *includePattern) String() string {
+	if ip.negate {
+		return "!" + ip.str
+	}
+	return ip.str
+}
+
+// match checks the pattern against name. full is true if the pattern
+// matches name or one of its parent directories. partial is true if the
+// pattern could match a path inside name, in which case direct reports
+// that this does not depend on "**" absorbing the last component of name.
+func (ip *includePattern) match(name string) (full, partial, direct bool) {
+	return matchIncludeParts(ip.parts, strings.Split(name, string(filepath.Separator)), false)
+}
+
+func matchIncludeParts(pattern, name []string, starred bool) (full, partial, direct bool) {
+	if len(pattern) == 0 {
+		return true, false, false
 	}
-	m, _ := filepath.Match(pattern, name)
-	return m, partial
+	if len(name) == 0 {
+		full = true
+		for _, p := range pattern {
+			if p != "**" {
+				full = false
+				break
+			}
+		}
+		return full, true, !starred
+	}
+	if pattern[0] == "**" {
+		f1, p1, d1 := matchIncludeParts(pattern[1:], name, starred)
+		if f1 {
+			return true, p1, d1
+		}
+		f2, p2, d2 := matchIncludeParts(pattern, name[1:], true)
+		return f2, p1 || p2, d1 || d2
+	}
+	if ok, _ := filepath.Match(pattern[0], name[0]); !ok {
+		return false, false, false
+	}
+	return matchIncludeParts(pattern[1:], name[1:], false)
 }
 
-func trimUntilIndex(str, sep string, count int) string {
-	s := str
-	i := 0
-	c := 0
-	for {
-		idx := strings.Index(s, sep)
-		s = s[idx+len(sep):]
-		i += idx + len(sep)
-		c++
-		if c > count {
-			return str[:i-len(sep)]
+// matchIncludePatterns reports if path should be walked according to the
+// include patterns. Later patterns take precedence over earlier ones. full
+// is returned when everything under a directory is known to be included so
+// that matching can be skipped for its children. decider is the pattern
+// responsible for the result, if any.
+func matchIncludePatterns(patterns []*includePattern, path string, isDir bool) (matched, full bool, decider *includePattern) {
+	var included, partial *includePattern
+	exceptions := false
+	for _, p := range patterns {
+		f, pa, direct := p.match(path)
+		if p.negate {
+			if f {
+				included = nil
+				partial = nil
+				decider = p
+			} else if pa {
+				exceptions = true
+			}
+			continue
+		}
+		if f {
+			included = p
+		} else if pa && (isDir || direct) && partial == nil {
+			partial = p
 		}
 	}
+	switch {
+	case included != nil:
+		decider = included
+	case partial != nil:
+		decider = partial
+	}
+	return included != nil || partial != nil, included != nil && !exceptions, decider
+}
+
+// dedupeIncludePatterns removes patterns that are already covered by a
+// parent pattern. Patterns are kept as is if any exceptions are used as
+// their order is significant then.
+func dedupeIncludePatterns(in []*includePattern) []*includePattern {
+	strs := make([]string, 0, len(in))
+	for _, p := range in {
+		if p.negate {
+			return in
+		}
+		strs = append(strs, p.str)
+	}
+	strs = dedupePaths(strs)
+	if strs == nil {
+		return nil
+	}
+	out := make([]*includePattern, 0, len(strs))
+	for _, s := range strs {
+		out = append(out, newIncludePattern(s))
+	}
+	return out
 }
 
 func isNotExist(err error) bool {
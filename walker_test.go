@@ -13,6 +13,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tonistiigi/fsutil/types"
 )
 
@@ -130,6 +131,76 @@ file bar/foo
 `, string(b.Bytes()))
 }
 
+func TestWalkerIncludeDoubleStar(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz.go file",
+		"ADD foo file",
+		"ADD src dir",
+		"ADD src/a.go file",
+		"ADD src/a.txt file",
+		"ADD src/lib dir",
+		"ADD src/lib/b.go file",
+		"ADD src/lib/b_test.go file",
+		"ADD src/vendor dir",
+		"ADD src/vendor/c.go file",
+		"ADD src/vendor/keep dir",
+		"ADD src/vendor/keep/d.go file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"src/**/*.go"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `dir src
+file src/a.go
+dir src/lib
+file src/lib/b.go
+file src/lib/b_test.go
+dir src/vendor
+file src/vendor/c.go
+dir src/vendor/keep
+file src/vendor/keep/d.go
+`, string(b.Bytes()))
+
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"src", "!src/vendor", "!**/*_test.go", "src/vendor/keep"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `dir src
+file src/a.go
+file src/a.txt
+dir src/lib
+file src/lib/b.go
+dir src/vendor
+dir src/vendor/keep
+file src/vendor/keep/d.go
+`, string(b.Bytes()))
+
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"**/[ab]*.go"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `dir bar
+file bar/baz.go
+dir src
+file src/a.go
+dir src/lib
+file src/lib/b.go
+file src/lib/b_test.go
+dir src/vendor
+dir src/vendor/keep
+`, string(b.Bytes()))
+}
+
 func TestWalkerExclude(t *testing.T) {
 	d, err := tmpDir(changeStream([]string{
 		"ADD bar file",
@@ -152,6 +223,157 @@ file foo/bar2
 
 }
 
+func TestPathFilter(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar dir",
+		"ADD bar/baz dir",
+		"ADD bar/baz/a.txt file",
+		"ADD bar/baz/b.log file",
+		"ADD bar/foo file",
+		"ADD foo2 file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	includes := []string{"bar", "foo*"}
+	excludes := []string{"**/*.log", "bar/foo"}
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: includes,
+		ExcludePatterns: excludes,
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	// matching the paths of a walk without the filter gives the same result
+	f, err := NewPathFilter(includes, excludes)
+	assert.NoError(t, err)
+	b2 := &bytes.Buffer{}
+	err = filepath.Walk(d, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == d {
+			return err
+		}
+		rel, err := filepath.Rel(d, p)
+		if err != nil {
+			return err
+		}
+		ok, err := f.Match(rel, fi.IsDir())
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		t := "file"
+		if fi.IsDir() {
+			t = "dir"
+		}
+		fmt.Fprintf(b2, "%s %s\n", t, filepath.ToSlash(rel))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, `dir bar
+dir bar/baz
+file bar/baz/a.txt
+file foo2
+`, string(b.Bytes()))
+	assert.Equal(t, string(b.Bytes()), string(b2.Bytes()))
+
+	_, err = NewPathFilter(nil, []string{"["})
+	assert.Error(t, err)
+}
+
+func TestWalkerIgnoreFiles(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD .gitignore file",
+		"ADD bar file",
+		"ADD build dir",
+		"ADD build/out file",
+		"ADD foo.log file",
+		"ADD keep.log file",
+		"ADD src dir",
+		"ADD src/.gitignore file",
+		"ADD src/a.go file",
+		"ADD src/a.tmp file",
+		"ADD src/bar file",
+		"ADD src/build file",
+		"ADD src/sub dir",
+		"ADD src/sub/a.tmp file",
+		"ADD src/sub/b.go file",
+		"ADD src/sub/deep dir",
+		"ADD src/sub/deep/c.go file",
+		"ADD src/sub/deep/c.txt file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	err = ioutil.WriteFile(filepath.Join(d, ".gitignore"), []byte("# comment\n*.log\n!keep.log\nbuild/\n/bar\nsrc/**/*.txt\n"), 0600)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(filepath.Join(d, "src/.gitignore"), []byte("*.tmp\n!sub/*.tmp\n"), 0600)
+	assert.NoError(t, err)
+
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IgnoreFiles: []string{".gitignore"},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+
+	assert.Equal(t, `file .gitignore
+file keep.log
+dir src
+file src/.gitignore
+file src/a.go
+file src/bar
+file src/build
+dir src/sub
+file src/sub/a.tmp
+file src/sub/b.go
+dir src/sub/deep
+file src/sub/deep/c.go
+`, string(b.Bytes()))
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"foo", "foo", false, true},
+		{"foo", "a/b/foo", false, true},
+		{"/foo", "a/foo", false, false},
+		{"a/foo", "a/foo", false, true},
+		{"a/foo", "b/a/foo", false, false},
+		{"foo/", "foo", false, false},
+		{"foo/", "a/foo", true, true},
+		{"**/foo/bar", "x/y/foo/bar", false, true},
+		{"a/**", "a/b/c", false, true},
+		{"a/**", "a", true, false},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"*.go", "a/b.go", false, true},
+		{"a/*.go", "a/b/c.go", false, false},
+		{"[a-c]?.txt", "b1.txt", false, true},
+		{"[!a-c]?.txt", "b1.txt", false, false},
+		{"\\#foo", "#foo", false, true},
+		{"\\!foo", "!foo", false, true},
+		{"foo\\ ", "foo ", false, true},
+		{"foo  ", "foo", false, true},
+	}
+	for _, c := range cases {
+		r, err := parseIgnoreRule(c.pattern, ".gitignore")
+		require.NoError(t, err)
+		require.NotNil(t, r, c.pattern)
+		m := r.re.MatchString(c.path) && (!r.dirOnly || c.isDir)
+		assert.Equal(t, c.match, m, "%q %q", c.pattern, c.path)
+	}
+}
+
 func TestWalkerFollowLinks(t *testing.T) {
 	d, err := tmpDir(changeStream([]string{
 		"ADD bar file",
@@ -234,54 +456,182 @@ file _foo2
 `, string(b.Bytes()))
 }
 
-func TestMatchPrefix(t *testing.T) {
-	ok, partial := matchPrefix("foo", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, false, partial)
+func TestWalkerTrace(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD .gitignore file",
+		"ADD bar dir",
+		"ADD bar/a.log file",
+		"ADD bar/b file",
+		"ADD baz file",
+		"ADD foo dir",
+		"ADD foo/keep file",
+		"ADD foo/x file",
+		"ADD out dir",
+		"ADD out/x file",
+		"ADD qux file",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	err = ioutil.WriteFile(filepath.Join(d, ".gitignore"), []byte("*.log\nout/\n"), 0600)
+	assert.NoError(t, err)
 
-	ok, partial = matchPrefix("foo/bar/baz", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		IncludePatterns: []string{"bar", "foo", "out", "qux", ".gitignore"},
+		ExcludePatterns: []string{"foo", "!foo/keep"},
+		IgnoreFiles:     []string{".gitignore"},
+		Map: func(_ string, s *types.Stat) bool {
+			return s.Path != "qux"
+		},
+		Trace: func(tr FilterTrace) {
+			fmt.Fprintf(b, "%s %s %s %q %s\n", tr.Path, tr.Decision, tr.Rule, tr.Pattern, tr.IgnoreFile)
+		},
+	}, func(string, os.FileInfo, error) error {
+		return nil
+	})
+	assert.NoError(t, err)
 
-	ok, partial = matchPrefix("foo/bar/baz", "foo/bar")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+	assert.Equal(t, `.gitignore included include ".gitignore" 
+bar included include "bar" 
+bar/a.log excluded ignorefile "*.log" .gitignore
+bar/b included include "bar" 
+baz excluded include "" 
+foo included exclude "!foo/keep" 
+foo/keep included exclude "!foo/keep" 
+foo/x excluded exclude "foo" 
+out skipped ignorefile "out/" .gitignore
+qux excluded map "" 
+`, string(b.Bytes()))
+}
 
-	ok, partial = matchPrefix("foo/bar/baz", "foo/bax")
-	assert.Equal(t, false, ok)
-	assert.Equal(t, true, partial)
+func TestWalkerLimitsHardlink(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD longname file data1",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
+	require.NoError(t, os.Link(filepath.Join(d, "longname"), filepath.Join(d, "x")))
+	require.NoError(t, os.Link(filepath.Join(d, "longname"), filepath.Join(d, "y")))
 
-	ok, partial = matchPrefix("foo/bar/baz", "foo/bar/baz")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, false, partial)
+	// the first link that is walked becomes the link source
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		Limits: &Limits{MaxPathLength: 4, Handler: func(*LimitError) error { return nil }},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file x
+file y >x
+`, string(b.Bytes()))
 
-	ok, partial = matchPrefix("f*", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, false, partial)
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		Map: func(p string, _ *types.Stat) bool {
+			return p != "longname"
+		},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file x
+file y >x
+`, string(b.Bytes()))
+}
 
-	ok, partial = matchPrefix("foo/bar/*", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+func TestWalkerLimits(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD bar file data12",
+		"ADD foo dir",
+		"ADD foo/baz file data1",
+		"ADD foo/sub dir",
+		"ADD foo/sub/x file d",
+		"ADD foo2 file data123456",
+	}))
+	assert.NoError(t, err)
+	defer os.RemoveAll(d)
 
-	ok, partial = matchPrefix("foo/*/baz", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+	b := &bytes.Buffer{}
+	err = Walk(context.Background(), d, &WalkOpt{
+		Limits: &Limits{MaxFileSize: 6},
+	}, bufWalk(b))
+	var lerr *LimitError
+	require.True(t, errors.As(err, &lerr))
+	assert.Equal(t, "foo2", lerr.Path)
+	assert.Equal(t, LimitMaxFileSize, lerr.Kind)
+
+	var skipped []string
+	handler := func(err *LimitError) error {
+		skipped = append(skipped, err.Kind.String()+" "+err.Path)
+		return nil
+	}
 
-	ok, partial = matchPrefix("*/*/baz", "foo")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		Limits: &Limits{MaxDepth: 2, MaxTotalSize: 11, Handler: handler},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+file foo/baz
+dir foo/sub
+`, string(b.Bytes()))
+	assert.Equal(t, []string{"max depth foo/sub/x", "max total size foo2"}, skipped)
 
-	ok, partial = matchPrefix("*/bar/baz", "foo/bar")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, true, partial)
+	skipped = nil
+	b.Reset()
+	err = Walk(context.Background(), d, &WalkOpt{
+		Limits: &Limits{MaxEntries: 2, Handler: handler},
+	}, bufWalk(b))
+	assert.NoError(t, err)
+	assert.Equal(t, `file bar
+dir foo
+`, string(b.Bytes()))
+	assert.Equal(t, []string{"max entries foo/baz", "max entries foo/sub", "max entries foo2"}, skipped)
+}
 
-	ok, partial = matchPrefix("*/bar/baz", "foo/bax")
-	assert.Equal(t, false, ok)
-	assert.Equal(t, true, partial)
+func TestMatchIncludePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		full    bool
+		partial bool
+	}{
+		{"foo", "foo", true, false},
+		{"foo/bar/baz", "foo", false, true},
+		{"foo/bar/baz", "foo/bar", false, true},
+		{"foo/bar/baz", "foo/bax", false, false},
+		{"foo/bar/baz", "foo/bar/baz", true, false},
+		{"f*", "foo", true, false},
+		{"foo/bar/*", "foo", false, true},
+		{"foo/*/baz", "foo", false, true},
+		{"*/*/baz", "foo", false, true},
+		{"*/bar/baz", "foo/bar", false, true},
+		{"*/bar/baz", "foo/bax", false, false},
+		{"*/*/baz", "foo/bar/baz", true, false},
+		{"foo", "foo/bar", true, false},
+		{".", "foo", true, false},
+		{"**", "foo/bar", true, false},
+		{"**/*.go", "foo", false, true},
+		{"**/*.go", "foo.go", true, false},
+		{"**/*.go", "foo/bar/baz.go", true, false},
+		{"foo/**/*.go", "foo", false, true},
+		{"foo/**/*.go", "bar", false, false},
+		{"foo/**/*.go", "foo/a/b", false, true},
+		{"foo/**/*.go", "foo/a/b/c.go", true, false},
+		{"foo/**/*.go", "foo/c.go", true, false},
+		{"foo/**", "foo", true, true},
+		{"foo/**/bar", "foo/bar", true, false},
+		{"foo/**/[a-c]*", "foo/x/y/bar", true, false},
+		{"foo/**/[a-c]*", "foo/x/y/dar", false, true},
+	}
+	for _, c := range cases {
+		full, partial, _ := newIncludePattern(c.pattern).match(c.name)
+		assert.Equal(t, c.full, full, "full %q %q", c.pattern, c.name)
+		assert.Equal(t, c.partial, partial, "partial %q %q", c.pattern, c.name)
+	}
 
-	ok, partial = matchPrefix("*/*/baz", "foo/bar/baz")
-	assert.Equal(t, true, ok)
-	assert.Equal(t, false, partial)
+	_, _, direct := newIncludePattern("foo/bar").match("foo")
+	assert.True(t, direct)
+	_, _, direct = newIncludePattern("**/*.go").match("foo")
+	assert.False(t, direct)
 }
 
 func bufWalk(buf *bytes.Buffer) filepath.WalkFunc {
@@ -0,0 +1,65 @@
+package fsutil
+
+import "path"
+
+// xattrCapability holds the file capabilities. It is cleared by chown and
+// by writing to the file.
+const xattrCapability = "security.capability"
+
+// XattrFilter selects extended attributes by key. Patterns use path.Match
+// syntax, e.g. "user.*". A key is kept if it matches one of the Include
+// patterns, or Include is empty, and none of the Exclude patterns. Invalid
+// patterns never match.
+type XattrFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// Match returns true if the attribute key passes the filter. A nil filter
+// matches every key.
+func (f *XattrFilter) Match(key string) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Include) > 0 && !matchAny(f.Include, key) {
+		return false
+	}
+	return !matchAny(f.Exclude, key)
+}
+
+// Filter returns the attributes that pass the filter. xattrs is returned
+// unchanged if all of them pass.
+func (f *XattrFilter) Filter(xattrs map[string][]byte) map[string][]byte {
+	if f == nil {
+		return xattrs
+	}
+	var out map[string][]byte
+	for k := range xattrs {
+		if f.Match(k) {
+			continue
+		}
+		if out == nil {
+			out = make(map[string][]byte, len(xattrs))
+			for k, v := range xattrs {
+				out[k] = v
+			}
+		}
+		delete(out, k)
+	}
+	if out == nil {
+		return xattrs
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func matchAny(patterns []string, key string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, key); ok {
+			return true
+		}
+	}
+	return false
+}
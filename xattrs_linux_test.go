@@ -0,0 +1,251 @@
+package fsutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/continuity/sysx"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tonistiigi/fsutil/types"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestXattrFilterWalkTarReceive(t *testing.T) {
+	d, err := ioutil.TempDir("", "xattrs")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	p := filepath.Join(d, "foo")
+	require.NoError(t, ioutil.WriteFile(p, []byte("foo"), 0600))
+	if err := sysx.LSetxattr(p, "user.keep", []byte("1"), 0); err != nil {
+		t.Skipf("xattrs not supported: %v", err)
+	}
+	require.NoError(t, sysx.LSetxattr(p, "user.drop", []byte("2"), 0))
+
+	f := &XattrFilter{Exclude: []string{"user.drop"}}
+	expected := map[string][]byte{"user.keep": []byte("1")}
+
+	var stats []*StatInfo
+	err = Walk(context.Background(), d, &WalkOpt{XattrFilter: f}, func(p string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		stats = append(stats, fi.(*StatInfo))
+		return nil
+	})
+	require.NoError(t, err)
+	require.Len(t, stats, 1)
+	assert.Equal(t, expected, stats[0].Xattrs)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTarWithOpt(context.Background(), NewFS(d, nil), buf, TarWriterOpt{XattrFilter: f}))
+	hdr, err := tar.NewReader(buf).Next()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"SCHILY.xattr.user.keep": "1"}, hdr.PAXRecords)
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, nil), nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{XattrFilter: f})
+	})
+	require.NoError(t, eg.Wait())
+
+	keys, err := sysx.LListxattr(filepath.Join(dest, "foo"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.keep"}, keys)
+}
+
+func TestSendReceiveCapabilities(t *testing.T) {
+	d, err := ioutil.TempDir("", "caps")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	caps := setupCapabilities(t, d)
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, nil), nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{})
+	})
+	require.NoError(t, eg.Wait())
+
+	dt, err := sysx.LGetxattr(filepath.Join(dest, "ping"), "security.capability")
+	require.NoError(t, err)
+	assert.Equal(t, caps, dt)
+
+	fi, err := os.Stat(filepath.Join(dest, "suid"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSetuid|os.ModeSetgid|0755, fi.Mode())
+}
+
+// setupCapabilities creates a "ping" file with file capabilities and a
+// setuid "suid" file that are both owned by a non-root user, and returns the
+// capabilities. The test is skipped if capabilities can't be set.
+func setupCapabilities(t *testing.T, d string) []byte {
+	// revision 2 with the effective flag and CAP_NET_RAW permitted
+	caps := []byte{1, 0, 0, 2, 0, 0x20, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	p := filepath.Join(d, "ping")
+	require.NoError(t, ioutil.WriteFile(p, []byte("ping"), 0755))
+	if err := os.Chown(p, 1, 1); err != nil {
+		t.Skipf("chown not permitted: %v", err)
+	}
+	if err := sysx.LSetxattr(p, "security.capability", caps, 0); err != nil {
+		t.Skipf("capabilities not supported: %v", err)
+	}
+	caps, err := sysx.LGetxattr(p, "security.capability")
+	require.NoError(t, err)
+
+	p = filepath.Join(d, "suid")
+	require.NoError(t, ioutil.WriteFile(p, []byte("suid"), 0755))
+	require.NoError(t, os.Chown(p, 1, 1))
+	require.NoError(t, os.Chmod(p, os.ModeSetuid|os.ModeSetgid|0755))
+	return caps
+}
+
+func TestSendReceiveACL(t *testing.T) {
+	d, err := ioutil.TempDir("", "acl")
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	acl, err := ACLFromText("user::rwx,user:1000:rwx,group::r-x,mask::rwx,other::r-x")
+	require.NoError(t, err)
+
+	require.NoError(t, os.Mkdir(filepath.Join(d, "cache"), 0755))
+	if err := sysx.LSetxattr(filepath.Join(d, "cache"), xattrACLDefault, acl, 0); err != nil {
+		t.Skipf("acls not supported: %v", err)
+	}
+	// inherits the default acl
+	require.NoError(t, ioutil.WriteFile(filepath.Join(d, "cache/foo"), []byte("foo"), 0644))
+	fooACL, err := sysx.LGetxattr(filepath.Join(d, "cache/foo"), xattrACLAccess)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(d, "bar"), []byte("bar"), 0644))
+
+	dest, err := ioutil.TempDir("", "dest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, sysx.LSetxattr(dest, xattrACLDefault, acl, 0))
+
+	eg, ctx := errgroup.WithContext(context.Background())
+	s1, s2 := sockPairProto(ctx)
+	eg.Go(func() error {
+		defer s1.(*fakeConnProto).closeSend()
+		return Send(ctx, s1, NewFS(d, nil), nil)
+	})
+	eg.Go(func() error {
+		return Receive(ctx, s2, dest, ReceiveOpt{})
+	})
+	require.NoError(t, eg.Wait())
+
+	dt, err := sysx.LGetxattr(filepath.Join(dest, "cache"), xattrACLDefault)
+	require.NoError(t, err)
+	assert.Equal(t, acl, dt)
+	dt, err = sysx.LGetxattr(filepath.Join(dest, "cache/foo"), xattrACLAccess)
+	require.NoError(t, err)
+	assert.Equal(t, fooACL, dt)
+
+	// the acl inherited from the destination is removed
+	_, err = sysx.LGetxattr(filepath.Join(dest, "bar"), xattrACLAccess)
+	assert.True(t, errors.Is(err, sysx.ENODATA), "%v", err)
+	fi, err := os.Stat(filepath.Join(dest, "bar"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode())
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteTar(context.Background(), NewFS(d, nil), buf))
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		xattrs, err := XattrsFromPAX(hdr.PAXRecords)
+		require.NoError(t, err)
+		switch hdr.Name {
+		case "cache/":
+			assert.Equal(t, "user::rwx,user:1000:rwx,group::r-x,mask::rwx,other::r-x", hdr.PAXRecords["SCHILY.acl.default"])
+			assert.Equal(t, map[string][]byte{xattrACLDefault: acl}, xattrs)
+		case "cache/foo":
+			assert.Equal(t, map[string][]byte{xattrACLAccess: fooACL}, xattrs)
+		default:
+			assert.Nil(t, xattrs)
+		}
+	}
+}
+
+func TestReceiveXattrErrors(t *testing.T) {
+	d, err := tmpDir(changeStream([]string{
+		"ADD foo file data",
+	}))
+	require.NoError(t, err)
+	defer os.RemoveAll(d)
+
+	receive := func(key string, h XattrErrorHandler) error {
+		dest, err := ioutil.TempDir("", "dest")
+		require.NoError(t, err)
+		defer os.RemoveAll(dest)
+
+		eg, ctx := errgroup.WithContext(context.Background())
+		s1, s2 := sockPairProto(ctx)
+		eg.Go(func() error {
+			defer s1.(*fakeConnProto).closeSend()
+			return Send(ctx, s1, NewFS(d, &WalkOpt{
+				Map: func(_ string, s *types.Stat) bool {
+					s.Xattrs = map[string][]byte{key: []byte("1")}
+					return true
+				},
+			}), nil)
+		})
+		eg.Go(func() error {
+			return Receive(ctx, s2, dest, ReceiveOpt{XattrErrorHandler: h})
+		})
+		return eg.Wait()
+	}
+
+	// the namespace is not supported by any filesystem
+	const invalid = "invalid.foo"
+	// not a valid capability
+	const capability = "security.capability"
+
+	// errors are ignored by default except for capabilities
+	require.NoError(t, receive(invalid, nil))
+	err = receive(capability, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), capability)
+
+	var keys []string
+	handler := func(p, key string, err error) error {
+		keys = append(keys, key)
+		return err
+	}
+	require.Error(t, receive(invalid, handler))
+	assert.Equal(t, []string{invalid}, keys)
+
+	// the handler can ignore capability errors
+	require.NoError(t, receive(capability, func(string, string, error) error {
+		return nil
+	}))
+}
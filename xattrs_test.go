@@ -0,0 +1,39 @@
+package fsutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXattrFilter(t *testing.T) {
+	xattrs := map[string][]byte{
+		"user.foo":            []byte("foo"),
+		"security.selinux":    []byte("label"),
+		"security.capability": []byte("cap"),
+		"trusted.bar":         []byte("bar"),
+	}
+
+	var f *XattrFilter
+	assert.True(t, f.Match("security.selinux"))
+	assert.Equal(t, xattrs, f.Filter(xattrs))
+
+	f = &XattrFilter{Exclude: []string{"security.selinux"}}
+	assert.Equal(t, map[string][]byte{
+		"user.foo":            []byte("foo"),
+		"security.capability": []byte("cap"),
+		"trusted.bar":         []byte("bar"),
+	}, f.Filter(xattrs))
+
+	f = &XattrFilter{Include: []string{"user.*", "security.*"}, Exclude: []string{"security.selinux"}}
+	assert.True(t, f.Match("user.foo"))
+	assert.False(t, f.Match("trusted.bar"))
+	assert.Equal(t, map[string][]byte{
+		"user.foo":            []byte("foo"),
+		"security.capability": []byte("cap"),
+	}, f.Filter(xattrs))
+	assert.Len(t, xattrs, 4)
+
+	f = &XattrFilter{Include: []string{"none.*"}}
+	assert.Nil(t, f.Filter(xattrs))
+}